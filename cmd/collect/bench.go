@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// runBench runs count collect-and-push cycles through the production code
+// paths and prints latency percentiles for each phase.
+func runBench(envValues EnvValues, count int) error {
+	if count < 1 {
+		return errors.New("-count must be at least 1")
+	}
+
+	client := newSwitchBotClient(&envValues)
+	var fetch, format, push []time.Duration
+	for i := 0; i < count; i++ {
+		ctx := withRequestID(context.Background(), newRequestID())
+
+		start := time.Now()
+		status, err := client.getMeterProCO2Status(ctx)
+		if err != nil {
+			return fmt.Errorf("cycle %d: fetch: %w", i+1, err)
+		}
+		fetch = append(fetch, time.Since(start))
+
+		// The JSON sinks format and push in one step.
+		if envValues.Sink == "datadog" || envValues.Sink == "elasticsearch" {
+			start = time.Now()
+			send := sendDatadogSeries
+			if envValues.Sink == "elasticsearch" {
+				send = sendElasticsearchBulk
+			}
+			if err := send(ctx, status, envValues); err != nil {
+				return fmt.Errorf("cycle %d: push: %w", i+1, err)
+			}
+			push = append(push, time.Since(start))
+			continue
+		}
+
+		start = time.Now()
+		metrics, err := formatMetrics(status, envValues)
+		if err != nil {
+			return fmt.Errorf("cycle %d: format: %w", i+1, err)
+		}
+		format = append(format, time.Since(start))
+
+		start = time.Now()
+		if err := emit(ctx, metrics, envValues); err != nil {
+			return fmt.Errorf("cycle %d: push: %w", i+1, err)
+		}
+		push = append(push, time.Since(start))
+	}
+
+	fmt.Printf("%d cycles\n", count)
+	fmt.Printf("%-7s %12s %12s %12s %12s\n", "phase", "p50", "p90", "p99", "max")
+	printPercentiles("fetch", fetch)
+	printPercentiles("format", format)
+	printPercentiles("push", push)
+
+	return nil
+}
+
+func printPercentiles(phase string, durations []time.Duration) {
+	if len(durations) == 0 {
+		return
+	}
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	fmt.Printf("%-7s %12s %12s %12s %12s\n", phase,
+		percentile(durations, 50), percentile(durations, 90), percentile(durations, 99), durations[len(durations)-1])
+}
+
+// percentile returns the nearest-rank percentile of sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
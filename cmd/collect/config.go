@@ -0,0 +1,459 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+// exitConfigError is the process exit code used when the configuration is
+// invalid.
+const exitConfigError = 2
+
+var (
+	ErrMissingRequired = errors.New("missing required value")
+	ErrInvalidValue    = errors.New("invalid value")
+)
+
+// ConfigError describes a problem with a single configuration key. Err is
+// ErrMissingRequired or ErrInvalidValue.
+type ConfigError struct {
+	Key    string
+	Err    error
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Key, e.Reason)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrors collects every problem found while loading the configuration.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	var b strings.Builder
+	b.WriteString("invalid configuration:")
+	for _, err := range e {
+		b.WriteString("\n  - ")
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+func (e ConfigErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// ignoreMissing drops ErrMissingRequired errors for the given keys.
+func (e ConfigErrors) ignoreMissing(keys ...string) ConfigErrors {
+	var kept ConfigErrors
+	for _, err := range e {
+		if errors.Is(err, ErrMissingRequired) && slices.Contains(keys, err.Key) {
+			continue
+		}
+		kept = append(kept, err)
+	}
+	return kept
+}
+
+func (e *ConfigErrors) missing(key string) {
+	*e = append(*e, &ConfigError{Key: key, Err: ErrMissingRequired, Reason: "must be set"})
+}
+
+func (e *ConfigErrors) invalid(key, format string, a ...any) {
+	*e = append(*e, &ConfigError{Key: key, Err: ErrInvalidValue, Reason: fmt.Sprintf(format, a...)})
+}
+
+// ConfigOverrides holds settings given on the command line. Empty values
+// leave the environment setting in place.
+type ConfigOverrides struct {
+	Format    string
+	LogLevel  string
+	DeviceID  string
+	Timestamp string
+	// DryRun prints metrics to stdout instead of sending them.
+	DryRun bool
+}
+
+// LoadConfig reads the configuration from the environment, applies the
+// command-line overrides and validates the result. Settings are resolved
+// in order of precedence: flags, then environment, then defaults. All
+// problems found are returned together as ConfigErrors.
+func LoadConfig(overrides ConfigOverrides) (EnvValues, error) {
+	var ev EnvValues
+	if err := envconfig.Process("", &ev); err != nil {
+		var parseErr *envconfig.ParseError
+		if errors.As(err, &parseErr) {
+			return ev, ConfigErrors{{
+				Key:    parseErr.KeyName,
+				Err:    ErrInvalidValue,
+				Reason: fmt.Sprintf("cannot parse %q as %s", parseErr.Value, parseErr.TypeName),
+			}}
+		}
+		return ev, err
+	}
+
+	var errs ConfigErrors
+
+	if overrides.Format != "" {
+		ev.Format = overrides.Format
+	}
+	if overrides.LogLevel != "" {
+		ev.LogLevel = overrides.LogLevel
+	}
+	if overrides.DeviceID != "" {
+		ev.Co2DeviceID = overrides.DeviceID
+	}
+	if overrides.DryRun {
+		ev.Sink = "stdout"
+	}
+	if overrides.Timestamp != "" {
+		t, err := time.Parse(time.RFC3339, overrides.Timestamp)
+		if err != nil {
+			errs.invalid("-timestamp", "%q is not an RFC3339 time", overrides.Timestamp)
+		}
+		ev.Timestamp = t
+		ev.EmitTimestamp = true
+	}
+	// A rounded timestamp only aligns readings if it is written.
+	if ev.TimestampRound > 0 {
+		ev.EmitTimestamp = true
+	}
+
+	if ev.SwitchBotToken == "" {
+		errs.missing("SWITCH_BOT_TOKEN")
+	}
+	if ev.SwitchBotClientSecret == "" {
+		errs.missing("SWITCH_BOT_CLIENT_SECRET")
+	}
+	// Polling needs a device; webhook mode can accept reports from any
+	// device.
+	ev.Co2DeviceID = strings.TrimSpace(ev.Co2DeviceID)
+	if ev.Co2DeviceID == "" && ev.Mode != "webhook" {
+		errs.missing("CO2_DEVICE_ID")
+	}
+
+	if ev.SwitchBotMaxIdleConnsPerHost < 0 {
+		errs.invalid("SWITCH_BOT_MAX_IDLE_CONNS_PER_HOST", "%d must not be negative", ev.SwitchBotMaxIdleConnsPerHost)
+	}
+	if ev.SwitchBotMaxConnsPerHost < 0 {
+		errs.invalid("SWITCH_BOT_MAX_CONNS_PER_HOST", "%d must not be negative", ev.SwitchBotMaxConnsPerHost)
+	}
+
+	if ev.HTTPTimeout <= 0 {
+		errs.invalid("HTTP_TIMEOUT", "%s must be positive", ev.HTTPTimeout)
+	}
+	if ev.MaxResponseBytes <= 0 {
+		errs.invalid("MAX_RESPONSE_BYTES", "%d must be positive", ev.MaxResponseBytes)
+	}
+
+	if ev.BatteryLowThreshold < 0 || ev.BatteryLowThreshold > 100 {
+		errs.invalid("BATTERY_LOW_THRESHOLD", "%d must be between 0 and 100", ev.BatteryLowThreshold)
+	}
+
+	for _, scale := range []struct {
+		key   string
+		value float64
+	}{
+		{"TEMPERATURE_SCALE", ev.TemperatureScale},
+		{"BATTERY_SCALE", ev.BatteryScale},
+		{"HUMIDITY_SCALE", ev.HumidityScale},
+		{"CO2_SCALE", ev.Co2Scale},
+	} {
+		if scale.value == 0 {
+			errs.invalid(scale.key, "must not be zero")
+		}
+	}
+
+	switch ev.LogLevel {
+	case "info", "debug":
+	default:
+		errs.invalid("LOG_LEVEL", "%q must be info or debug", ev.LogLevel)
+	}
+
+	for _, name := range ev.FloatFields {
+		switch name {
+		case "battery", "humidity", "co2":
+		default:
+			errs.invalid("FLOAT_FIELDS", "%q must be one of battery, humidity, co2", name)
+		}
+	}
+
+	for name, value := range ev.OfflinePlaceholder {
+		if !validateOfflinePlaceholder(name, value) {
+			errs.invalid("OFFLINE_PLACEHOLDER", "%s:%v must name temperature, battery, humidity or co2, with a whole number for the latter three", name, value)
+		}
+	}
+
+	switch ev.ExtraFieldsAs {
+	case "tag", "field":
+	default:
+		errs.invalid("EXTRA_FIELDS_AS", "%q must be tag or field", ev.ExtraFieldsAs)
+	}
+	for _, name := range ev.ExtraFields {
+		if err := validateFieldKey(name); err != nil {
+			errs.invalid("EXTRA_FIELDS", "%v", err)
+		}
+	}
+
+	for _, key := range ev.TagsAsFields {
+		switch key {
+		case "quality", "firmware_version":
+		default:
+			errs.invalid("TAGS_AS_FIELDS", "%q must be one of quality, firmware_version", key)
+		}
+	}
+
+	for name, mapped := range ev.FieldNames {
+		switch name {
+		case "temperature", "battery", "humidity", "co2":
+		default:
+			errs.invalid("FIELD_NAMES", "%q must be one of temperature, battery, humidity, co2", name)
+		}
+		if err := validateFieldKey(mapped); err != nil {
+			errs.invalid("FIELD_NAMES", "%s: %v", name, err)
+		}
+	}
+
+	if ev.Sink == "" {
+		ev.Sink = "stdout"
+		if ev.PushURL != "" {
+			ev.Sink = "push"
+		}
+	}
+
+	switch ev.Sink {
+	case "stdout":
+	case "push":
+		if ev.PushURL == "" {
+			errs.missing("PUSH_URL")
+		} else if err := validatePushURLTemplate(ev.PushURL, ev); err != nil {
+			errs.invalid("PUSH_URL", "%v", err)
+		}
+		if err := validatePushURLTemplate(ev.PushURLFallback, ev); err != nil {
+			errs.invalid("PUSH_URL_FALLBACK", "%v", err)
+		}
+		if ev.APIKey == "" {
+			errs.missing("API_KEY")
+		}
+	case "syslog":
+		if _, ok := syslogFacilities[ev.SyslogFacility]; !ok {
+			errs.invalid("SYSLOG_FACILITY", "%q is not a syslog facility", ev.SyslogFacility)
+		}
+		if _, ok := syslogSeverities[ev.SyslogSeverity]; !ok {
+			errs.invalid("SYSLOG_SEVERITY", "%q is not a syslog severity", ev.SyslogSeverity)
+		}
+	case "file":
+		if ev.FilePath == "" {
+			errs.missing("FILE_PATH")
+		}
+		if ev.FileMaxBytes < 0 {
+			errs.invalid("FILE_MAX_BYTES", "%d must not be negative", ev.FileMaxBytes)
+		}
+		if ev.FileMaxAge < 0 {
+			errs.invalid("FILE_MAX_AGE", "%s must not be negative", ev.FileMaxAge)
+		}
+		if ev.FileMaxBackups < 0 {
+			errs.invalid("FILE_MAX_BACKUPS", "%d must not be negative", ev.FileMaxBackups)
+		}
+	case "unix":
+		if ev.UnixSocketPath == "" {
+			errs.missing("UNIX_SOCKET_PATH")
+		}
+	case "udp":
+		if ev.UDPAddr == "" {
+			errs.missing("UDP_ADDR")
+		}
+		if ev.UDPMaxDatagramBytes <= 0 {
+			errs.invalid("UDP_MAX_DATAGRAM_BYTES", "%d must be positive", ev.UDPMaxDatagramBytes)
+		}
+	case "datadog":
+		if ev.DatadogAPIKey == "" {
+			errs.missing("DD_API_KEY")
+		}
+	case "elasticsearch":
+		if ev.ElasticsearchURL == "" {
+			errs.missing("ELASTICSEARCH_URL")
+		}
+		if ev.ElasticsearchIndex == "" {
+			errs.missing("ELASTICSEARCH_INDEX")
+		}
+	default:
+		errs.invalid("SINK", "%q must be push, stdout, file, syslog, unix, udp, datadog or elasticsearch", ev.Sink)
+	}
+
+	switch ev.PushMethod {
+	case http.MethodPost, http.MethodPut:
+	default:
+		errs.invalid("PUSH_METHOD", "%q must be POST or PUT", ev.PushMethod)
+	}
+
+	for _, code := range ev.PushSuccessCodes {
+		if code < 100 || code > 599 {
+			errs.invalid("PUSH_SUCCESS_CODES", "%d is not an HTTP status code", code)
+		}
+	}
+
+	switch ev.PushRedirectPolicy {
+	case "same-host", "reauth", "none":
+	default:
+		errs.invalid("PUSH_REDIRECT_POLICY", "%q must be same-host, reauth or none", ev.PushRedirectPolicy)
+	}
+
+	switch certFile, keyFile := ev.PushClientCertFile, ev.PushClientKeyFile; {
+	case certFile == "" && keyFile == "":
+	case certFile == "":
+		errs.missing("PUSH_CLIENT_CERT_FILE")
+	case keyFile == "":
+		errs.missing("PUSH_CLIENT_KEY_FILE")
+	default:
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			errs.invalid("PUSH_CLIENT_CERT_FILE", "%v", err)
+		}
+	}
+
+	if ev.HeartbeatEnabled && (ev.Sink == "datadog" || ev.Sink == "elasticsearch") {
+		errs.invalid("HEARTBEAT_ENABLED", "is not supported with SINK %s", ev.Sink)
+	}
+	if ev.SelfMetricsEnabled && (ev.Sink == "datadog" || ev.Sink == "elasticsearch") {
+		errs.invalid("SELF_METRICS_ENABLED", "is not supported with SINK %s", ev.Sink)
+	}
+
+	switch ev.Format {
+	case "influx", "prometheus", "carbon2":
+	case "openmetrics":
+		// An OpenMetrics exposition is a whole: split at lines, only the
+		// last part would end in # EOF and metadata could be parted from
+		// its samples.
+		if ev.Sink == "udp" {
+			errs.invalid("FORMAT", "openmetrics is not supported with SINK udp")
+		}
+		if ev.MaxPayloadBytes > 0 {
+			errs.invalid("MAX_PAYLOAD_BYTES", "is not supported with FORMAT openmetrics")
+		}
+	case "protobuf":
+		// The payload is binary, so it can't be split into lines or sent
+		// to the line-oriented sinks.
+		if ev.Sink != "push" && ev.Sink != "stdout" {
+			errs.invalid("FORMAT", "protobuf is only supported with SINK push or stdout")
+		}
+		if ev.MaxPayloadBytes > 0 {
+			errs.invalid("MAX_PAYLOAD_BYTES", "is not supported with FORMAT protobuf")
+		}
+	default:
+		errs.invalid("FORMAT", "%q must be influx, prometheus, openmetrics, carbon2 or protobuf", ev.Format)
+	}
+
+	if ev.TimestampRound < 0 {
+		errs.invalid("TIMESTAMP_ROUND", "%s must not be negative", ev.TimestampRound)
+	}
+	if _, ok := timestampUnits[ev.TimestampUnit]; !ok {
+		errs.invalid("TIMESTAMP_UNIT", "%q must be ns, us, ms or s", ev.TimestampUnit)
+	}
+
+	if err := validateMeasurementTemplate(ev); err != nil {
+		errs.invalid("MEASUREMENT_TEMPLATE", "%v", err)
+	}
+
+	switch ev.LineSchema {
+	case "field", "measurement":
+	default:
+		errs.invalid("LINE_SCHEMA", "%q must be field or measurement", ev.LineSchema)
+	}
+
+	switch ev.Mode {
+	case "poll", "webhook":
+	default:
+		errs.invalid("MODE", "%q must be poll or webhook", ev.Mode)
+	}
+	if ev.WebhookMaxBodyBytes <= 0 {
+		errs.invalid("WEBHOOK_MAX_BODY_BYTES", "%d must be positive", ev.WebhookMaxBodyBytes)
+	}
+
+	if len(errs) > 0 {
+		return ev, errs
+	}
+	return ev, nil
+}
+
+const redactedValue = "********"
+
+// dumpConfig writes the configuration as indented JSON. String fields tagged
+// `redact:"true"` are masked when set; those tagged `redact:"url"` keep the
+// URL but mask its userinfo and credential query parameters.
+func dumpConfig(w io.Writer, envValues EnvValues) error {
+	v := reflect.ValueOf(&envValues).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := v.Field(i)
+		if f.Kind() != reflect.String || f.String() == "" {
+			continue
+		}
+		switch t.Field(i).Tag.Get("redact") {
+		case "true":
+			f.SetString(redactedValue)
+		case "url":
+			f.SetString(redactURL(f.String()))
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(envValues)
+}
+
+// credentialParams are substrings of query parameter names whose values
+// redactURL masks.
+var credentialParams = []string{"key", "token", "secret", "password", "passwd", "auth", "sig", "credential"}
+
+// redactURL masks the userinfo and credential query parameter values of
+// rawURL. It works on the raw string so placeholders such as {device_id}
+// are left unescaped.
+func redactURL(rawURL string) string {
+	if _, rest, ok := strings.Cut(rawURL, "//"); ok {
+		authority := rest
+		if end := strings.IndexAny(rest, "/?#"); end >= 0 {
+			authority = rest[:end]
+		}
+		if at := strings.LastIndex(authority, "@"); at >= 0 {
+			rawURL = strings.Replace(rawURL, "//"+authority[:at+1], "//"+redactedValue+"@", 1)
+		}
+	}
+
+	base, query, ok := strings.Cut(rawURL, "?")
+	if !ok {
+		return rawURL
+	}
+	query, fragment, hasFragment := strings.Cut(query, "#")
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		name, _, _ := strings.Cut(param, "=")
+		lower := strings.ToLower(name)
+		if slices.ContainsFunc(credentialParams, func(s string) bool { return strings.Contains(lower, s) }) {
+			params[i] = name + "=" + redactedValue
+		}
+	}
+	rawURL = base + "?" + strings.Join(params, "&")
+	if hasFragment {
+		rawURL += "#" + fragment
+	}
+	return rawURL
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// datadogGauge is the series type value for gauges in the v2 series API.
+const datadogGauge = 3
+
+type datadogPoint struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+type datadogSeries struct {
+	Metric string         `json:"metric"`
+	Type   int            `json:"type"`
+	Points []datadogPoint `json:"points"`
+	Tags   []string       `json:"tags"`
+}
+
+// buildDatadogSeries maps each field of the reading to its own gauge series.
+// Datadog expects timestamps in seconds.
+func buildDatadogSeries(status *MeterProCO2Status, envValues EnvValues) []datadogSeries {
+	var tags []string
+	for _, t := range readingTags(status, envValues) {
+		tags = append(tags, t.key+":"+t.value)
+	}
+
+	var series []datadogSeries
+	for _, f := range readingFields(status, envValues) {
+		var value float64
+		switch v := f.value.(type) {
+		case float64:
+			value = v
+		case int:
+			value = float64(v)
+		default:
+			continue
+		}
+
+		seriesTags := tags
+		if envValues.UnitTags && f.unit != "" {
+			seriesTags = append(slices.Clip(tags), "unit:"+f.unit)
+		}
+
+		series = append(series, datadogSeries{
+			Metric: measurementName(status, envValues) + "." + f.name,
+			Type:   datadogGauge,
+			Points: []datadogPoint{{Timestamp: status.FetchedAt.Unix(), Value: value}},
+			Tags:   seriesTags,
+		})
+	}
+	return series
+}
+
+// marshalDatadogSeries builds the request body for the v2 series API.
+func marshalDatadogSeries(status *MeterProCO2Status, envValues EnvValues) ([]byte, error) {
+	payload, err := json.Marshal(struct {
+		Series []datadogSeries `json:"series"`
+	}{buildDatadogSeries(status, envValues)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal series: %w", err)
+	}
+	return payload, nil
+}
+
+func sendDatadogSeries(ctx context.Context, status *MeterProCO2Status, envValues EnvValues) error {
+	payload, err := marshalDatadogSeries(status, envValues)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(payload))
+
+	ctx, cancel := context.WithTimeout(ctx, envValues.HTTPTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("https://api.%s/api/v2/series", envValues.DatadogSite)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("DD-API-KEY", envValues.DatadogAPIKey)
+	req.Header.Set(requestIDHeader, requestIDFrom(ctx))
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send series: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := authError(resp.StatusCode, "Datadog API"); err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := readBody(resp.Body, envValues.MaxResponseBytes)
+		return fmt.Errorf("received non-2xx response: %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
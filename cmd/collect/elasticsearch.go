@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// elasticsearchIndex returns the daily index a reading is written to, e.g.
+// metric-ferry-2024.05.01.
+func elasticsearchIndex(status *MeterProCO2Status, envValues EnvValues) string {
+	return envValues.ElasticsearchIndex + "-" + status.FetchedAt.UTC().Format("2006.01.02")
+}
+
+// buildElasticsearchDocument maps a reading to a single document holding its
+// tags and fields as top-level keys.
+func buildElasticsearchDocument(status *MeterProCO2Status, envValues EnvValues) map[string]any {
+	doc := map[string]any{
+		"@timestamp":  status.FetchedAt.UTC().Format(time.RFC3339Nano),
+		"measurement": measurementName(status, envValues),
+	}
+	for _, t := range readingTags(status, envValues) {
+		doc[t.key] = t.value
+	}
+	for _, f := range readingFields(status, envValues) {
+		doc[f.name] = f.value
+	}
+	return doc
+}
+
+// marshalElasticsearchBulk builds the NDJSON request body for the _bulk API.
+func marshalElasticsearchBulk(status *MeterProCO2Status, envValues EnvValues) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+
+	action := map[string]any{"index": map[string]string{"_index": elasticsearchIndex(status, envValues)}}
+	if err := enc.Encode(action); err != nil {
+		return nil, fmt.Errorf("failed to marshal bulk action: %w", err)
+	}
+	if err := enc.Encode(buildElasticsearchDocument(status, envValues)); err != nil {
+		return nil, fmt.Errorf("failed to marshal document: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// elasticsearchBulkResponse is the part of a _bulk response needed to find
+// rejected items.
+type elasticsearchBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Index  string          `json:"_index"`
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+func sendElasticsearchBulk(ctx context.Context, status *MeterProCO2Status, envValues EnvValues) error {
+	payload, err := marshalElasticsearchBulk(status, envValues)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(string(payload))
+
+	ctx, cancel := context.WithTimeout(ctx, envValues.HTTPTimeout)
+	defer cancel()
+
+	url := strings.TrimSuffix(envValues.ElasticsearchURL, "/") + "/_bulk"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set(requestIDHeader, requestIDFrom(ctx))
+	if envValues.ElasticsearchAPIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+envValues.ElasticsearchAPIKey)
+	} else if envValues.ElasticsearchUsername != "" {
+		req.SetBasicAuth(envValues.ElasticsearchUsername, envValues.ElasticsearchPassword)
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send bulk request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := authError(resp.StatusCode, "Elasticsearch"); err != nil {
+		return err
+	}
+	body, err := readBody(resp.Body, envValues.MaxResponseBytes)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("received non-2xx response: %d, body: %s", resp.StatusCode, string(body))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	// A 200 response may still reject individual items.
+	var bulk elasticsearchBulkResponse
+	if err := json.Unmarshal(body, &bulk); err != nil {
+		return fmt.Errorf("failed to parse bulk response: %w", err)
+	}
+	if !bulk.Errors {
+		return nil
+	}
+
+	rejected := 0
+	for _, item := range bulk.Items {
+		for action, result := range item {
+			if result.Status >= 200 && result.Status < 300 {
+				continue
+			}
+			rejected++
+			cyclePrintln(ctx, "Rejected bulk", action, "into", result.Index+":", result.Status, string(result.Error))
+		}
+	}
+	return fmt.Errorf("%d of %d bulk items rejected", rejected, len(bulk.Items))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// fileMu serializes writes and rotation of FILE_PATH, as webhook mode
+// publishes concurrently.
+var fileMu sync.Mutex
+
+// emitFile appends metrics to FILE_PATH, rotating it first when the write
+// would take it past FILE_MAX_BYTES or when its last write was in an earlier
+// FILE_MAX_AGE window. Windows are aligned to the zero time, so a 24h age
+// rotates at the first write after each UTC midnight.
+func emitFile(metrics string, envValues EnvValues) error {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	path := envValues.FilePath
+	info, err := os.Stat(path)
+	switch {
+	case err == nil:
+		if info.Size() > 0 && needsRotation(info, len(metrics), envValues, time.Now()) {
+			if err := rotateFile(path, envValues.FileMaxBackups, envValues.FileCompress); err != nil {
+				return fmt.Errorf("failed to rotate %s: %w", path, err)
+			}
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(metrics); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write to %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+func needsRotation(info fs.FileInfo, incoming int, envValues EnvValues, now time.Time) bool {
+	if envValues.FileMaxBytes > 0 && info.Size()+int64(incoming) > envValues.FileMaxBytes {
+		return true
+	}
+	if envValues.FileMaxAge > 0 && info.ModTime().Truncate(envValues.FileMaxAge).Before(now.Truncate(envValues.FileMaxAge)) {
+		return true
+	}
+	return false
+}
+
+// rotateFile moves path to path.1 (path.1.gz when compressing), shifting
+// older backups up by one and dropping any beyond backups.
+func rotateFile(path string, backups int, compress bool) error {
+	ext := ""
+	if compress {
+		ext = ".gz"
+	}
+	backup := func(n int) string {
+		return fmt.Sprintf("%s.%d%s", path, n, ext)
+	}
+
+	if backups <= 0 {
+		return os.Remove(path)
+	}
+	if err := os.Remove(backup(backups)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for n := backups - 1; n >= 1; n-- {
+		if err := os.Rename(backup(n), backup(n+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	if !compress {
+		return os.Rename(path, backup(1))
+	}
+	if err := gzipFile(path, backup(1)); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
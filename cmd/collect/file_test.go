@@ -0,0 +1,71 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestEmitFileRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.log")
+	ev := EnvValues{FilePath: path, FileMaxBytes: 10, FileMaxBackups: 2}
+
+	// The second write fits exactly; the third would exceed the limit.
+	for _, metrics := range []string{"aaaaa\n", "bbb\n", "c\n", "dddd\n", "eeee\n"} {
+		if err := emitFile(metrics, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, want := range map[string]string{
+		path:        "eeee\n",
+		path + ".1": "c\ndddd\n",
+		path + ".2": "aaaaa\nbbb\n",
+	} {
+		if got := readTestFile(t, name); got != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(name), got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("backup beyond FILE_MAX_BACKUPS kept: %v", err)
+	}
+}
+
+func TestEmitFileRotatesCompressed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.log")
+	ev := EnvValues{FilePath: path, FileMaxBytes: 8, FileMaxBackups: 1, FileCompress: true}
+
+	for _, metrics := range []string{"aaaaa\n", "bbbbb\n"} {
+		if err := emitFile(metrics, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path + ".1.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "aaaaa\n" {
+		t.Errorf("rotated file = %q, want %q", got, "aaaaa\n")
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+type tag struct {
+	key   string
+	value string
+}
+
+// point is a single value of a measurement, as emitted on one line of
+// output.
+type point struct {
+	measurement string
+	tags        []tag
+	field       metricField
+	// time is written with the point when set.
+	time time.Time
+}
+
+func formatMetrics(status *MeterProCO2Status, envValues EnvValues) (string, error) {
+	floatFields := make(map[string]bool, len(envValues.FloatFields))
+	for _, name := range envValues.FloatFields {
+		floatFields[name] = true
+	}
+
+	var points []point
+	for _, f := range readingFields(status, envValues) {
+		if v, ok := f.value.(int); ok && floatFields[f.name] {
+			f.value = float64(v)
+		}
+		if mapped, ok := envValues.FieldNames[f.name]; ok {
+			f.name = mapped
+		}
+
+		measurement := measurementName(status, envValues)
+		if envValues.LineSchema == "measurement" {
+			measurement, f.name = f.name, "value"
+		}
+
+		tags := readingTags(status, envValues)
+		if envValues.UnitTags && f.unit != "" {
+			tags = append(tags, tag{"unit", f.unit})
+		}
+
+		p := point{
+			measurement: measurement,
+			tags:        tags,
+			field:       f,
+		}
+		// Carbon 2.0 requires a timestamp, so it always carries the
+		// reading's.
+		if envValues.EmitTimestamp || envValues.Format == "carbon2" {
+			p.time = status.FetchedAt
+		}
+		points = append(points, p)
+	}
+
+	return renderPoints(points, envValues)
+}
+
+// readingFields returns the reported fields of a reading followed by the
+// enabled derived fields.
+func readingFields(status *MeterProCO2Status, envValues EnvValues) []metricField {
+	fields := status.fields()
+	// A zero-filled battery is not a low one.
+	if envValues.BatteryLowEnabled && status.Battery != nil && !status.batteryFilled {
+		low := 0
+		if *status.Battery < envValues.BatteryLowThreshold {
+			low = 1
+		}
+		fields = append(fields, metricField{name: "battery_low", value: low})
+	}
+	if envValues.HeatIndexEnabled && status.Temperature != nil && status.Humidity != nil {
+		hi := heatIndex(*status.Temperature, float64(*status.Humidity))
+		fields = append(fields, metricField{name: "heat_index", value: hi, unit: "celsius"})
+	}
+	if envValues.RssiEnabled && status.RSSI != nil {
+		fields = append(fields, metricField{name: "rssi", value: *status.RSSI})
+	}
+	for _, t := range statusTags(status, envValues) {
+		if slices.Contains(envValues.TagsAsFields, t.key) {
+			fields = append(fields, metricField{name: t.key, value: t.value})
+		}
+	}
+	if envValues.ExtraFieldsAs == "field" {
+		fields = append(fields, status.Extras...)
+	}
+	return fields
+}
+
+// readingTags returns the tags attached to every point of a reading, less
+// those emitted as fields instead.
+func readingTags(status *MeterProCO2Status, envValues EnvValues) []tag {
+	var tags []tag
+	for _, t := range statusTags(status, envValues) {
+		if !slices.Contains(envValues.TagsAsFields, t.key) {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// statusTags returns every enabled tag of a reading.
+func statusTags(status *MeterProCO2Status, envValues EnvValues) []tag {
+	tags := []tag{{"device_id", envValues.Co2DeviceID}}
+	if envValues.QualityTag && status.Quality != "" {
+		tags = append(tags, tag{"quality", status.Quality})
+	}
+	if envValues.FirmwareVersionTag && status.FirmwareVersion != "" {
+		tags = append(tags, tag{"firmware_version", status.FirmwareVersion})
+	}
+	if envValues.ExtraFieldsAs == "tag" {
+		for _, f := range status.Extras {
+			tags = append(tags, tag{f.name, fmt.Sprint(f.value)})
+		}
+	}
+	if len(envValues.OfflinePlaceholder) > 0 {
+		online := "1"
+		if status.Offline {
+			online = "0"
+		}
+		tags = append(tags, tag{"online", online})
+	}
+	return tags
+}
+
+// validateFieldKey checks that name can be written as a line protocol field
+// key (or measurement name) without escaping.
+func validateFieldKey(name string) error {
+	if name == "" {
+		return errors.New("name must not be empty")
+	}
+	if strings.HasPrefix(name, "_") {
+		return fmt.Errorf("name %q must not start with an underscore", name)
+	}
+	if strings.ContainsAny(name, " ,=\"\\\n") {
+		return fmt.Errorf("name %q must not contain spaces, commas, equals signs, quotes, backslashes or newlines", name)
+	}
+	return nil
+}
+
+// renderPoints serializes points in the configured payload format.
+func renderPoints(points []point, envValues EnvValues) (string, error) {
+	switch envValues.Format {
+	case "prometheus":
+		return formatPrometheus(points, prometheusOptions{
+			unitSuffix:  envValues.PrometheusUnitSuffix,
+			strictNames: envValues.PrometheusStrictNames,
+		})
+	case "openmetrics":
+		return formatPrometheus(points, prometheusOptions{
+			openMetrics: true,
+			unitSuffix:  true,
+			strictNames: envValues.PrometheusStrictNames,
+		})
+	case "carbon2":
+		return formatCarbon2(points, time.Now())
+	case "protobuf":
+		return formatProtobuf(points), nil
+	default:
+		return formatLineProtocol(points, lineTimestamp(envValues))
+	}
+}
+
+// contentType returns the Content-Type header value for a payload format.
+func contentType(format string) string {
+	switch format {
+	case "prometheus":
+		return "text/plain; version=0.0.4"
+	case "openmetrics":
+		return "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	case "protobuf":
+		return "application/x-protobuf; messageType=metricferry.Batch"
+	default:
+		return "text/plain"
+	}
+}
+
+func formatLineProtocol(points []point, timestamp func(time.Time) int64) (string, error) {
+	var metrics bytes.Buffer
+
+	for _, p := range points {
+		if _, err := fmt.Fprint(&metrics, p.measurement); err != nil {
+			return "", err
+		}
+		for _, t := range p.tags {
+			if _, err := fmt.Fprintf(&metrics, ",%s=%s", t.key, escapeTagValue(t.value)); err != nil {
+				return "", err
+			}
+		}
+
+		var err error
+		switch v := p.field.value.(type) {
+		case float64:
+			_, err = fmt.Fprintf(&metrics, " %s=%f", p.field.name, v)
+		case int:
+			_, err = fmt.Fprintf(&metrics, " %s=%d", p.field.name, v)
+		case string:
+			_, err = fmt.Fprintf(&metrics, " %s=\"%s\"", p.field.name, escapeFieldString(v))
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if !p.time.IsZero() {
+			_, err = fmt.Fprintf(&metrics, " %d", timestamp(p.time))
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, err := fmt.Fprint(&metrics, "\n"); err != nil {
+			return "", err
+		}
+	}
+
+	return metrics.String(), nil
+}
+
+// prometheusOptions selects the variant produced by formatPrometheus.
+type prometheusOptions struct {
+	// openMetrics produces OpenMetrics text, which requires unitSuffix.
+	openMetrics bool
+	// unitSuffix appends the unit to metric names, e.g. co2_ppm.
+	unitSuffix bool
+	// strictNames rejects invalid metric names instead of sanitizing them.
+	strictNames bool
+}
+
+// formatPrometheus renders points as gauges in the Prometheus text
+// exposition format. Each point becomes a metric named after its
+// measurement and field; a field named "value" uses the measurement name
+// alone. With unitSuffix, the unit is appended to the name unless already
+// there. In OpenMetrics mode, unit metadata is added and the payload is
+// terminated with "# EOF". OpenMetrics only allows exemplars on counters
+// and histograms, so none are emitted for these gauges. Names with
+// characters Prometheus does not allow are sanitized, or rejected with
+// strictNames.
+func formatPrometheus(points []point, opts prometheusOptions) (string, error) {
+	var metrics bytes.Buffer
+
+	// Samples of a metric family must be contiguous, so group them by name
+	// while keeping the order in which names first appear.
+	var names []string
+	samples := make(map[string][]point)
+	units := make(map[string]string)
+	for _, p := range points {
+		// The exposition format only carries numeric samples.
+		if _, ok := p.field.value.(string); ok {
+			continue
+		}
+
+		name := p.measurement
+		if p.field.name != "value" {
+			name += "_" + p.field.name
+		}
+		if sanitized := sanitizeMetricName(name); sanitized != name {
+			if opts.strictNames {
+				return "", fmt.Errorf("invalid Prometheus metric name %q", name)
+			}
+			name = sanitized
+		}
+		if opts.unitSuffix && p.field.unit != "" {
+			if !strings.HasSuffix(name, "_"+p.field.unit) {
+				name += "_" + p.field.unit
+			}
+			if opts.openMetrics {
+				units[name] = p.field.unit
+			}
+		}
+		if _, ok := samples[name]; !ok {
+			names = append(names, name)
+		}
+		samples[name] = append(samples[name], p)
+	}
+
+	for _, name := range names {
+		if _, err := fmt.Fprintf(&metrics, "# TYPE %s gauge\n", name); err != nil {
+			return "", err
+		}
+		if unit, ok := units[name]; ok {
+			if _, err := fmt.Fprintf(&metrics, "# UNIT %s %s\n", name, unit); err != nil {
+				return "", err
+			}
+		}
+
+		for _, p := range samples[name] {
+			if _, err := fmt.Fprint(&metrics, name); err != nil {
+				return "", err
+			}
+			for i, t := range p.tags {
+				sep := ","
+				if i == 0 {
+					sep = "{"
+				}
+				if _, err := fmt.Fprintf(&metrics, "%s%s=\"%s\"", sep, t.key, escapeLabelValue(t.value)); err != nil {
+					return "", err
+				}
+			}
+			if len(p.tags) > 0 {
+				if _, err := fmt.Fprint(&metrics, "}"); err != nil {
+					return "", err
+				}
+			}
+
+			var err error
+			switch v := p.field.value.(type) {
+			case float64:
+				_, err = fmt.Fprintf(&metrics, " %f", v)
+			case int:
+				_, err = fmt.Fprintf(&metrics, " %d", v)
+			}
+			if err != nil {
+				return "", err
+			}
+
+			// Prometheus timestamps are in milliseconds, OpenMetrics
+			// timestamps in seconds.
+			if !p.time.IsZero() {
+				if opts.openMetrics {
+					_, err = fmt.Fprintf(&metrics, " %.3f", float64(p.time.UnixMilli())/1000)
+				} else {
+					_, err = fmt.Fprintf(&metrics, " %d", p.time.UnixMilli())
+				}
+			}
+			if err != nil {
+				return "", err
+			}
+			if _, err := fmt.Fprint(&metrics, "\n"); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if opts.openMetrics {
+		if _, err := fmt.Fprint(&metrics, "# EOF\n"); err != nil {
+			return "", err
+		}
+	}
+
+	return metrics.String(), nil
+}
+
+// formatCarbon2 renders points as Carbon 2.0 lines: the intrinsic tags
+// (metric, field and the point's tags such as device_id), two spaces, the
+// meta tags (unit, unless UNIT_TAGS made it intrinsic), then the value and
+// a timestamp in seconds. Carbon 2.0 requires a timestamp, so points
+// without one are stamped with now.
+func formatCarbon2(points []point, now time.Time) (string, error) {
+	var metrics bytes.Buffer
+
+	for _, p := range points {
+		// Carbon only carries numeric values.
+		if _, ok := p.field.value.(string); ok {
+			continue
+		}
+
+		intrinsic := []string{"metric=" + escapeCarbon2Tag(p.measurement), "field=" + escapeCarbon2Tag(p.field.name)}
+		hasUnit := false
+		for _, t := range p.tags {
+			intrinsic = append(intrinsic, t.key+"="+escapeCarbon2Tag(t.value))
+			hasUnit = hasUnit || t.key == "unit"
+		}
+		var meta []string
+		if p.field.unit != "" && !hasUnit {
+			meta = append(meta, "unit="+p.field.unit)
+		}
+
+		if _, err := fmt.Fprintf(&metrics, "%s  ", strings.Join(intrinsic, " ")); err != nil {
+			return "", err
+		}
+		if len(meta) > 0 {
+			if _, err := fmt.Fprintf(&metrics, "%s ", strings.Join(meta, " ")); err != nil {
+				return "", err
+			}
+		}
+
+		var err error
+		switch v := p.field.value.(type) {
+		case float64:
+			_, err = fmt.Fprintf(&metrics, "%f", v)
+		case int:
+			_, err = fmt.Fprintf(&metrics, "%d", v)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		t := p.time
+		if t.IsZero() {
+			t = now
+		}
+		if _, err := fmt.Fprintf(&metrics, " %d\n", t.Unix()); err != nil {
+			return "", err
+		}
+	}
+
+	return metrics.String(), nil
+}
+
+var invalidMetricNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// sanitizeMetricName maps name onto the Prometheus metric name charset
+// [a-zA-Z_:][a-zA-Z0-9_:]*, replacing other characters with underscores
+// and prefixing a leading digit with one.
+func sanitizeMetricName(name string) string {
+	name = invalidMetricNameChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+var tagValueEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// escapeTagValue escapes commas, equals signs and spaces in a line protocol
+// tag value.
+func escapeTagValue(v string) string {
+	return tagValueEscaper.Replace(v)
+}
+
+var fieldStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// escapeFieldString escapes backslashes and double quotes in a line protocol
+// string field value.
+func escapeFieldString(v string) string {
+	return fieldStringEscaper.Replace(v)
+}
+
+var carbon2TagEscaper = strings.NewReplacer(" ", "_", "=", "_")
+
+// escapeCarbon2Tag replaces the spaces and equals signs Carbon 2.0 uses as
+// separators in a tag value.
+func escapeCarbon2Tag(v string) string {
+	return carbon2TagEscaper.Replace(v)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabelValue escapes backslashes, double quotes and newlines in a
+// Prometheus label value as the exposition format requires.
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
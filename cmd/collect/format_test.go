@@ -0,0 +1,340 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStatus returns a complete reading.
+func testStatus() *MeterProCO2Status {
+	temperature, battery, humidity, co2 := 21.5, 90, 45, 812
+	return &MeterProCO2Status{
+		Temperature: &temperature,
+		Battery:     &battery,
+		Humidity:    &humidity,
+		CO2:         &co2,
+		FetchedAt:   time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Quality:     "ok",
+	}
+}
+
+func TestFormatMetricsFloatFields(t *testing.T) {
+	tests := []struct {
+		name        string
+		floatFields string
+		want        string
+	}{
+		{
+			name: "default",
+			want: "meterproco2_status,device_id=DEV1 temperature=21.500000\n" +
+				"meterproco2_status,device_id=DEV1 battery=90\n" +
+				"meterproco2_status,device_id=DEV1 humidity=45\n" +
+				"meterproco2_status,device_id=DEV1 co2=812\n",
+		},
+		{
+			name:        "humidity and battery as floats",
+			floatFields: "humidity,battery",
+			want: "meterproco2_status,device_id=DEV1 temperature=21.500000\n" +
+				"meterproco2_status,device_id=DEV1 battery=90.000000\n" +
+				"meterproco2_status,device_id=DEV1 humidity=45.000000\n" +
+				"meterproco2_status,device_id=DEV1 co2=812\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := testEnvValues(t, map[string]string{"FLOAT_FIELDS": tt.floatFields})
+			got, err := formatMetrics(testStatus(), ev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("formatMetrics() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatMetricsLineSchema(t *testing.T) {
+	tests := []struct {
+		schema string
+		want   string
+	}{
+		{
+			schema: "field",
+			want: "meterproco2_status,device_id=DEV1 temperature=21.500000\n" +
+				"meterproco2_status,device_id=DEV1 battery=90\n" +
+				"meterproco2_status,device_id=DEV1 humidity=45\n" +
+				"meterproco2_status,device_id=DEV1 co2=812\n",
+		},
+		{
+			schema: "measurement",
+			want: "temperature,device_id=DEV1 value=21.500000\n" +
+				"battery,device_id=DEV1 value=90\n" +
+				"humidity,device_id=DEV1 value=45\n" +
+				"co2,device_id=DEV1 value=812\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.schema, func(t *testing.T) {
+			ev := testEnvValues(t, map[string]string{"LINE_SCHEMA": tt.schema})
+			got, err := formatMetrics(testStatus(), ev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("formatMetrics() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{`plain`, `plain`},
+		{`back\slash`, `back\\slash`},
+		{`"quoted"`, `\"quoted\"`},
+		{"new\nline", `new\nline`},
+		{"all \\ \" \n", `all \\ \" \n`},
+	}
+	for _, tt := range tests {
+		if got := escapeLabelValue(tt.value); got != tt.want {
+			t.Errorf("escapeLabelValue(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestFormatPrometheusLabelEscaping(t *testing.T) {
+	points := []point{{
+		measurement: "meterproco2_status",
+		tags:        []tag{{"device_id", "Living \"Room\"\\\n2"}},
+		field:       metricField{name: "co2", value: 812},
+	}}
+	got, err := formatPrometheus(points, prometheusOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# TYPE meterproco2_status_co2 gauge\n" +
+		`meterproco2_status_co2{device_id="Living \"Room\"\\\n2"} 812` + "\n"
+	if got != want {
+		t.Errorf("formatPrometheus() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFormatMetricsFieldNames(t *testing.T) {
+	ev := testEnvValues(t, map[string]string{"FIELD_NAMES": "temperature:temp_c,humidity:rh,battery:batt,co2:ppm"})
+	got, err := formatMetrics(testStatus(), ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "meterproco2_status,device_id=DEV1 temp_c=21.500000\n" +
+		"meterproco2_status,device_id=DEV1 batt=90\n" +
+		"meterproco2_status,device_id=DEV1 rh=45\n" +
+		"meterproco2_status,device_id=DEV1 ppm=812\n"
+	if got != want {
+		t.Errorf("formatMetrics() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// fieldValue returns the value of the named field in fields.
+func fieldValue(fields []metricField, name string) (any, bool) {
+	for _, f := range fields {
+		if f.name == name {
+			return f.value, true
+		}
+	}
+	return nil, false
+}
+
+func TestReadingFieldsBatteryLow(t *testing.T) {
+	ev := testEnvValues(t, map[string]string{"BATTERY_LOW_ENABLED": "true", "BATTERY_LOW_THRESHOLD": "20"})
+	tests := []struct {
+		battery int
+		want    int
+	}{
+		{0, 1},
+		{19, 1},
+		{20, 0},
+		{21, 0},
+		{100, 0},
+	}
+	for _, tt := range tests {
+		status := testStatus()
+		status.Battery = &tt.battery
+		fields := readingFields(status, ev)
+		if got, _ := fieldValue(fields, "battery_low"); got != tt.want {
+			t.Errorf("battery %d: battery_low = %v, want %d", tt.battery, got, tt.want)
+		}
+		if got, _ := fieldValue(fields, "battery"); got != tt.battery {
+			t.Errorf("battery %d: battery = %v, want the raw value", tt.battery, got)
+		}
+	}
+}
+
+func TestReadingFieldsBatteryLowZeroFilled(t *testing.T) {
+	ev := testEnvValues(t, map[string]string{"BATTERY_LOW_ENABLED": "true"})
+	status := testStatus()
+	status.Battery = nil
+	status.fillMissing()
+	if got, ok := fieldValue(readingFields(status, ev), "battery_low"); ok {
+		t.Errorf("battery_low = %v for a zero-filled battery, want none", got)
+	}
+}
+
+func TestFormatMetricsCarbon2(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{
+			name: "meta unit",
+			env:  map[string]string{"FORMAT": "carbon2", "QUALITY_TAG": "true"},
+			want: "metric=meterproco2_status field=temperature device_id=DEV1 quality=ok  unit=celsius 21.500000 1714564800\n" +
+				"metric=meterproco2_status field=battery device_id=DEV1 quality=ok  unit=percent 90 1714564800\n" +
+				"metric=meterproco2_status field=humidity device_id=DEV1 quality=ok  unit=percent 45 1714564800\n" +
+				"metric=meterproco2_status field=co2 device_id=DEV1 quality=ok  unit=ppm 812 1714564800\n",
+		},
+		{
+			name: "intrinsic unit",
+			env:  map[string]string{"FORMAT": "carbon2", "UNIT_TAGS": "true"},
+			want: "metric=meterproco2_status field=temperature device_id=DEV1 unit=celsius  21.500000 1714564800\n" +
+				"metric=meterproco2_status field=battery device_id=DEV1 unit=percent  90 1714564800\n" +
+				"metric=meterproco2_status field=humidity device_id=DEV1 unit=percent  45 1714564800\n" +
+				"metric=meterproco2_status field=co2 device_id=DEV1 unit=ppm  812 1714564800\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := formatMetrics(testStatus(), testEnvValues(t, tt.env))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("formatMetrics() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeMetricName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"meterproco2_status_co2", "meterproco2_status_co2"},
+		{"meter-pro_co2", "meter_pro_co2"},
+		{"meter.pro.co2", "meter_pro_co2"},
+		{"2nd_floor_co2", "_2nd_floor_co2"},
+		{"ns:co2", "ns:co2"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeMetricName(tt.name); got != tt.want {
+			t.Errorf("sanitizeMetricName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFormatPrometheusStrictNames(t *testing.T) {
+	for _, measurement := range []string{"meter-pro", "meter.pro", "2nd_floor"} {
+		points := []point{{measurement: measurement, field: metricField{name: "co2", value: 812}}}
+		if _, err := formatPrometheus(points, prometheusOptions{strictNames: true}); err == nil {
+			t.Errorf("%s: invalid name accepted in strict mode", measurement)
+		}
+		if _, err := formatPrometheus(points, prometheusOptions{}); err != nil {
+			t.Errorf("%s: %v", measurement, err)
+		}
+	}
+}
+
+func TestFormatMetricsPrometheusUnitSuffix(t *testing.T) {
+	tests := []struct {
+		suffix string
+		want   string
+	}{
+		{
+			suffix: "false",
+			want: "# TYPE meterproco2_status_temperature gauge\n" +
+				"meterproco2_status_temperature{device_id=\"DEV1\"} 21.500000\n" +
+				"# TYPE meterproco2_status_battery gauge\n" +
+				"meterproco2_status_battery{device_id=\"DEV1\"} 90\n" +
+				"# TYPE meterproco2_status_humidity gauge\n" +
+				"meterproco2_status_humidity{device_id=\"DEV1\"} 45\n" +
+				"# TYPE meterproco2_status_co2 gauge\n" +
+				"meterproco2_status_co2{device_id=\"DEV1\"} 812\n",
+		},
+		{
+			suffix: "true",
+			want: "# TYPE meterproco2_status_temperature_celsius gauge\n" +
+				"meterproco2_status_temperature_celsius{device_id=\"DEV1\"} 21.500000\n" +
+				"# TYPE meterproco2_status_battery_percent gauge\n" +
+				"meterproco2_status_battery_percent{device_id=\"DEV1\"} 90\n" +
+				"# TYPE meterproco2_status_humidity_percent gauge\n" +
+				"meterproco2_status_humidity_percent{device_id=\"DEV1\"} 45\n" +
+				"# TYPE meterproco2_status_co2_ppm gauge\n" +
+				"meterproco2_status_co2_ppm{device_id=\"DEV1\"} 812\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run("PROMETHEUS_UNIT_SUFFIX="+tt.suffix, func(t *testing.T) {
+			ev := testEnvValues(t, map[string]string{"FORMAT": "prometheus", "PROMETHEUS_UNIT_SUFFIX": tt.suffix})
+			got, err := formatMetrics(testStatus(), ev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("formatMetrics() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatPrometheusUnitSuffixNotRepeated(t *testing.T) {
+	points := []point{{
+		measurement: "metric_ferry_cycle_duration_seconds",
+		field:       metricField{name: "value", value: 1.5, unit: "seconds"},
+	}}
+	got, err := formatPrometheus(points, prometheusOptions{openMetrics: true, unitSuffix: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# TYPE metric_ferry_cycle_duration_seconds gauge\n" +
+		"# UNIT metric_ferry_cycle_duration_seconds seconds\n" +
+		"metric_ferry_cycle_duration_seconds 1.500000\n" +
+		"# EOF\n"
+	if got != want {
+		t.Errorf("formatPrometheus() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFormatMetricsStringFieldEscaping(t *testing.T) {
+	ev := testEnvValues(t, map[string]string{"FIRMWARE_VERSION_TAG": "true", "TAGS_AS_FIELDS": "firmware_version"})
+	status := testStatus()
+	status.FirmwareVersion = `a"b\c`
+
+	got, err := formatMetrics(status, ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `meterproco2_status,device_id=DEV1 firmware_version="a\"b\\c"` + "\n"
+	if !strings.HasSuffix(got, want) {
+		t.Errorf("formatMetrics() =\n%s\nwant it to end with\n%s", got, want)
+	}
+}
+
+func TestEscapeFieldString(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{`V1.2`, `V1.2`},
+		{`say "hi"`, `say \"hi\"`},
+		{`C:\fw`, `C:\\fw`},
+		{`\"`, `\\\"`},
+	}
+	for _, tt := range tests {
+		if got := escapeFieldString(tt.value); got != tt.want {
+			t.Errorf("escapeFieldString(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
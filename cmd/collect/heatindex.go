@@ -0,0 +1,31 @@
+package main
+
+import "math"
+
+// heatIndex returns the apparent temperature in °C for an air temperature
+// in °C and relative humidity in percent, following the US National Weather
+// Service procedure: Steadman's simple formula, replaced by the Rothfusz
+// regression with its low- and high-humidity adjustments when the result
+// reaches 80 °F (26.7 °C). The regression was fitted for 80–110 °F and
+// 40–100 % humidity; below 80 °F the heat index is close to the air
+// temperature and the simple formula is used.
+func heatIndex(celsius, humidity float64) float64 {
+	t := celsius*9/5 + 32
+	rh := humidity
+
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + rh*0.094)
+	if (hi+t)/2 >= 80 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*rh -
+			0.22475541*t*rh - 0.00683783*t*t - 0.05481717*rh*rh +
+			0.00122874*t*t*rh + 0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+
+		switch {
+		case rh < 13 && t >= 80 && t <= 112:
+			hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+		case rh > 85 && t >= 80 && t <= 87:
+			hi += (rh - 85) / 10 * (87 - t) / 5
+		}
+	}
+
+	return (hi - 32) * 5 / 9
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func fahrenheitToCelsius(f float64) float64 {
+	return (f - 32) * 5 / 9
+}
+
+func TestHeatIndex(t *testing.T) {
+	// Expected values are from the NWS heat index chart, in °F, and
+	// are rounded to the nearest degree there.
+	tests := []struct {
+		tempF, humidity, wantF float64
+	}{
+		{80, 40, 80},
+		{90, 70, 106},
+		{100, 50, 118},
+		{86, 90, 105},
+		{84, 100, 103},
+	}
+	for _, tt := range tests {
+		got := heatIndex(fahrenheitToCelsius(tt.tempF), tt.humidity)
+		if want := fahrenheitToCelsius(tt.wantF); math.Abs(got-want) > fahrenheitToCelsius(33) {
+			t.Errorf("heatIndex(%v °F, %v%%) = %.2f °C, want %.2f °C", tt.tempF, tt.humidity, got, want)
+		}
+	}
+}
+
+func TestHeatIndexBelowRegressionRange(t *testing.T) {
+	// Below 80 °F the simple formula keeps the index near the air
+	// temperature.
+	for _, tt := range []struct{ celsius, humidity float64 }{
+		{15, 30},
+		{20, 50},
+		{24, 80},
+	} {
+		if got := heatIndex(tt.celsius, tt.humidity); math.Abs(got-tt.celsius) > 2 {
+			t.Errorf("heatIndex(%v °C, %v%%) = %.2f °C, want within 2 °C of the air temperature", tt.celsius, tt.humidity, got)
+		}
+	}
+}
@@ -2,179 +2,720 @@ package main
 
 import (
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/base64"
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	"os"
+	"slices"
+	"strings"
 	"time"
-
-	"github.com/kelseyhightower/envconfig"
 )
 
 type EnvValues struct {
-	SwitchBotToken        string `required:"true" split_words:"true"`
-	SwitchBotClientSecret string `required:"true" split_words:"true"`
-	Co2DeviceID           string `required:"true" split_words:"true"`
+	SwitchBotToken        string `split_words:"true" redact:"true"`
+	SwitchBotClientSecret string `split_words:"true" redact:"true"`
+	// Co2DeviceID is the device to poll. In webhook mode it filters
+	// incoming reports and may be left empty to accept all devices.
+	Co2DeviceID string `split_words:"true"`
+	// Co2DeviceName is a human-readable device name, used by the
+	// {device_name} PUSH_URL placeholder.
+	Co2DeviceName string `split_words:"true"`
+	// SwitchBotMaxIdleConnsPerHost and SwitchBotMaxConnsPerHost tune the
+	// connection pool to api.switch-bot.com. Zero max conns means no limit.
+	SwitchBotMaxIdleConnsPerHost int `default:"10" split_words:"true"`
+	SwitchBotMaxConnsPerHost     int `split_words:"true"`
+	// SwitchBotAcceptGzip requests gzip-compressed responses explicitly and
+	// decodes them, rather than leaving compression to the transport.
+	SwitchBotAcceptGzip bool `split_words:"true"`
+
+	// Sink selects where readings are sent: "push" posts the formatted
+	// metrics to PUSH_URL, "stdout" prints them, "syslog" logs them, "file"
+	// appends them to FILE_PATH, "unix" writes them to the socket at
+	// UNIX_SOCKET_PATH, "udp" sends them as datagrams to UDP_ADDR,
+	// "datadog" submits gauge series to the Datadog API and
+	// "elasticsearch" bulk-indexes documents into Elasticsearch or
+	// OpenSearch. When unset it is "push" if PUSH_URL is set and "stdout"
+	// otherwise.
+	Sink string
+
+	APIKey string `split_words:"true" redact:"true"`
+	// PushURL may contain {device_id}, {device_name} and {host}
+	// placeholders, substituted before each push.
+	PushURL string `split_words:"true" redact:"url"`
+	// PushURLFallback is pushed to, with PushFallbackAPIKey (or APIKey when
+	// unset), only when a push to PushURL fails. It takes the same
+	// placeholders as PushURL.
+	PushURLFallback    string `split_words:"true" redact:"url"`
+	PushFallbackAPIKey string `split_words:"true" redact:"true"`
+	// PushMethod is the HTTP method used to push: POST or PUT.
+	PushMethod string `default:"POST" split_words:"true"`
+	// PushSuccessCodes lists the push response codes treated as success,
+	// replacing the default of any 2xx.
+	PushSuccessCodes []int `split_words:"true"`
+	// PushRedirectPolicy controls redirects from the push endpoint:
+	// "same-host", "reauth" or "none". See pushRedirectPolicy.
+	PushRedirectPolicy string `default:"same-host" split_words:"true"`
+	// PushClientCertFile and PushClientKeyFile configure a client
+	// certificate presented to the push endpoint for mutual TLS.
+	PushClientCertFile string `split_words:"true"`
+	PushClientKeyFile  string `split_words:"true"`
+	// MaxPayloadBytes splits pushes into multiple requests at line
+	// boundaries when exceeded. Zero disables splitting.
+	MaxPayloadBytes int `split_words:"true"`
+
+	// HTTPTimeout bounds each outgoing request, including reading its
+	// response body. MaxResponseBytes caps how much of a body is read.
+	HTTPTimeout      time.Duration `default:"30s" split_words:"true"`
+	MaxResponseBytes int64         `default:"1048576" split_words:"true"`
+
+	// The *Scale and *Offset settings calibrate each reading as
+	// value*scale + offset, e.g. TEMPERATURE_SCALE=0.1 for devices reporting
+	// tenths of a degree or CO2_OFFSET=-40 for a sensor reading 40 ppm high.
+	// Integer fields are rounded to the nearest integer afterwards.
+	TemperatureScale  float64 `default:"1" split_words:"true"`
+	TemperatureOffset float64 `split_words:"true"`
+	BatteryScale      float64 `default:"1" split_words:"true"`
+	BatteryOffset     float64 `split_words:"true"`
+	HumidityScale     float64 `default:"1" split_words:"true"`
+	HumidityOffset    float64 `split_words:"true"`
+	Co2Scale          float64 `default:"1" split_words:"true"`
+	Co2Offset         float64 `split_words:"true"`
+
+	// PartialOK emits only the fields present in a reading instead of
+	// reporting absent fields as zero.
+	PartialOK bool `split_words:"true"`
+	// FailOnAnyDeviceError fails the run when any reading of a status
+	// response listing several devices fails to publish, even though others
+	// were delivered. When false, such a run succeeds and only logs the
+	// failures. A failed fetch or rejected credentials always fail the run.
+	FailOnAnyDeviceError bool `default:"true" split_words:"true"`
+
+	HeartbeatEnabled bool `split_words:"true"`
+	// SelfMetricsEnabled pushes metrics about the collector itself, such as
+	// metric_ferry_push_bytes, after each run.
+	SelfMetricsEnabled bool `split_words:"true"`
+
+	// LogLevel is "info" or "debug".
+	LogLevel string `default:"info" split_words:"true"`
+
+	// Mode selects the data source: "poll" fetches the device status from
+	// the SwitchBot API once, "webhook" serves SwitchBot webhook events.
+	Mode        string `default:"poll"`
+	WebhookAddr string `default:":8080" split_words:"true"`
+	WebhookPath string `default:"/webhook" split_words:"true"`
+	// WebhookMaxBodyBytes caps the size of a webhook request body.
+	WebhookMaxBodyBytes int64 `default:"65536" split_words:"true"`
+
+	// SyslogNetwork and SyslogAddr select a remote syslog daemon; both
+	// empty means the local one.
+	SyslogNetwork  string `split_words:"true"`
+	SyslogAddr     string `split_words:"true"`
+	SyslogFacility string `default:"local0" split_words:"true"`
+	SyslogSeverity string `default:"info" split_words:"true"`
+
+	UnixSocketPath string `split_words:"true"`
+
+	// FilePath is written by the file sink. It is rotated when a write
+	// would exceed FileMaxBytes or when FileMaxAge has passed (zero
+	// disables either), keeping FileMaxBackups older files, gzipped with
+	// FileCompress. See emitFile.
+	FilePath       string        `split_words:"true"`
+	FileMaxBytes   int64         `split_words:"true"`
+	FileMaxAge     time.Duration `split_words:"true"`
+	FileMaxBackups int           `default:"5" split_words:"true"`
+	FileCompress   bool          `split_words:"true"`
+
+	// UDPAddr is the host:port of the udp sink. UDPMaxDatagramBytes bounds
+	// each datagram; metrics are split between lines to fit.
+	UDPAddr             string `split_words:"true"`
+	UDPMaxDatagramBytes int    `default:"1400" split_words:"true"`
+
+	DatadogAPIKey string `envconfig:"DD_API_KEY" redact:"true"`
+	DatadogSite   string `envconfig:"DD_SITE" default:"datadoghq.com"`
+
+	// ElasticsearchIndex is suffixed with the reading's UTC date, e.g.
+	// metric-ferry-2024.05.01. ElasticsearchAPIKey takes precedence over
+	// basic auth with ElasticsearchUsername and ElasticsearchPassword.
+	ElasticsearchURL      string `split_words:"true" redact:"url"`
+	ElasticsearchIndex    string `default:"metric-ferry" split_words:"true"`
+	ElasticsearchAPIKey   string `split_words:"true" redact:"true"`
+	ElasticsearchUsername string `split_words:"true"`
+	ElasticsearchPassword string `split_words:"true" redact:"true"`
+
+	// LineSchema selects the line protocol layout: "field" emits every
+	// metric as a field of the MEASUREMENT_TEMPLATE measurement,
+	// "measurement" emits one measurement per metric with a single value
+	// field.
+	LineSchema string `default:"field" split_words:"true"`
+	// MeasurementTemplate names the measurement, and the Datadog metric
+	// prefix. It may contain {device_id}, {device_type} and {device_name}
+	// placeholders; see measurementName.
+	MeasurementTemplate string `default:"meterproco2_status" split_words:"true"`
+
+	// Format selects the push payload format: "influx" line protocol,
+	// "prometheus" text exposition, "openmetrics" text, "carbon2" Carbon
+	// 2.0 lines or "protobuf", a metricferry.Batch message as defined in
+	// metricferry.proto.
+	Format string `default:"influx"`
+
+	// PrometheusUnitSuffix appends each field's unit to Prometheus metric
+	// names, e.g. meterproco2_status_co2_ppm, as OpenMetrics always does.
+	PrometheusUnitSuffix bool `split_words:"true"`
+	// PrometheusStrictNames fails formatting when a Prometheus or
+	// OpenMetrics metric name contains characters outside
+	// [a-zA-Z0-9_:] instead of replacing them with underscores.
+	PrometheusStrictNames bool `split_words:"true"`
 
-	APIKey  string `required:"true" split_words:"true"`
-	PushURL string `required:"true" split_words:"true"`
+	// BatteryLowEnabled emits a battery_low field that is 1 when the battery
+	// level is below BatteryLowThreshold percent and 0 otherwise.
+	BatteryLowEnabled   bool `split_words:"true"`
+	BatteryLowThreshold int  `default:"20" split_words:"true"`
+
+	// HeatIndexEnabled emits a heat_index field, the apparent temperature
+	// in degrees Celsius derived from temperature and humidity. See
+	// heatIndex for the formula.
+	HeatIndexEnabled bool `split_words:"true"`
+
+	// RssiEnabled emits the signal strength as an rssi field (dBm) when the
+	// status response reports one.
+	RssiEnabled bool `split_words:"true"`
+
+	// OfflinePlaceholder maps fields to values pushed in place of a reading
+	// when the fetch fails or the device reports offline, e.g. "co2:-1".
+	// When set, every point carries an online tag (1 or 0).
+	OfflinePlaceholder map[string]float64 `split_words:"true"`
+
+	// ExtraFields lists additional status body keys (e.g. deviceMode) to
+	// capture, emitted as tags or, with ExtraFieldsAs "field", as fields.
+	// Other body keys are ignored.
+	ExtraFields   []string `split_words:"true"`
+	ExtraFieldsAs string   `default:"tag" split_words:"true"`
+
+	// QualityTag adds a quality tag (ok, offline or error) derived from the
+	// SwitchBot statusCode to every point.
+	QualityTag bool `split_words:"true"`
+
+	// FirmwareVersionTag adds a firmware_version tag when the device
+	// reports its firmware version.
+	FirmwareVersionTag bool `split_words:"true"`
+
+	// TagsAsFields emits the listed tags (quality, firmware_version) as
+	// string fields instead, keeping them out of the series key.
+	TagsAsFields []string `split_words:"true"`
+
+	// UnitTags adds a unit tag (celsius, percent, ppm) to every field.
+	UnitTags bool `split_words:"true"`
+
+	// EmitTimestamp writes the fetch time on every point instead of leaving
+	// it to the receiver.
+	EmitTimestamp bool `split_words:"true"`
+	// Timestamp overrides the fetch time of the reading. It is set from the
+	// -timestamp flag.
+	Timestamp time.Time `ignored:"true"`
+	// TimestampRound rounds reading timestamps down to a multiple of this
+	// duration since the zero time, e.g. 1m for the start of the UTC
+	// minute, so readings from different collectors line up. Setting it
+	// implies EmitTimestamp. Zero keeps the precise fetch time.
+	TimestampRound time.Duration `split_words:"true"`
+	// TimestampUnit (ns, us, ms or s) and TimestampEpoch, in Unix seconds,
+	// set how line protocol timestamps are written for stores expecting a
+	// non-standard unit or epoch. See lineTimestamp.
+	TimestampUnit  string `default:"ns" split_words:"true"`
+	TimestampEpoch int64  `split_words:"true"`
+
+	// FieldNames renames emitted fields, e.g. "temperature:temp_c,co2:ppm".
+	FieldNames map[string]string `split_words:"true"`
+
+	// FloatFields lists integer fields (battery, humidity, co2) to emit as
+	// floats instead.
+	FloatFields []string `split_words:"true"`
 }
 
+// MeterProCO2Status holds a device reading. A nil field was absent from
+// the response.
 type MeterProCO2Status struct {
-	Temperature float64
-	Battery     int
-	Humidity    int
-	CO2         int
+	Temperature *float64
+	Battery     *int
+	Humidity    *int
+	CO2         *int
+	// RSSI is the reported signal strength in dBm, if any.
+	RSSI *int
+
+	// FetchedAt is when the reading was taken.
+	FetchedAt time.Time
+	// Quality summarizes the device state reported with the reading: "ok",
+	// "offline" (device or hub unreachable) or "error". Empty if unknown.
+	Quality string
+	// FirmwareVersion is the device firmware version, if reported.
+	FirmwareVersion string
+	// DeviceID is the reporting device when a response lists several
+	// statuses. Empty means the configured CO2_DEVICE_ID.
+	DeviceID string
+	// DeviceType is the SwitchBot device type, e.g. "MeterPro(CO2)", if
+	// reported.
+	DeviceType string
+	// Extras holds the EXTRA_FIELDS values found in the status body.
+	Extras []metricField
+	// Offline marks a placeholder reading standing in for an unreachable
+	// device.
+	Offline bool
+	// batteryFilled marks a Battery that fillMissing zero-filled rather
+	// than one the device reported.
+	batteryFilled bool
+}
+
+type metricField struct {
+	name  string
+	value any
+	// unit is the OpenMetrics unit of the value, if any.
+	unit string
+}
+
+// fields returns the present fields of the reading in emission order.
+// Values are either float64 or int.
+func (s *MeterProCO2Status) fields() []metricField {
+	var fields []metricField
+	if s.Temperature != nil {
+		fields = append(fields, metricField{"temperature", *s.Temperature, "celsius"})
+	}
+	if s.Battery != nil {
+		fields = append(fields, metricField{"battery", *s.Battery, "percent"})
+	}
+	if s.Humidity != nil {
+		fields = append(fields, metricField{"humidity", *s.Humidity, "percent"})
+	}
+	if s.CO2 != nil {
+		fields = append(fields, metricField{"co2", *s.CO2, "ppm"})
+	}
+	return fields
+}
+
+// calibrate applies the configured scale and offset to each present field.
+func (s *MeterProCO2Status) calibrate(envValues EnvValues) {
+	if s.Temperature != nil {
+		v := *s.Temperature*envValues.TemperatureScale + envValues.TemperatureOffset
+		s.Temperature = &v
+	}
+	s.Battery = calibrateInt(s.Battery, envValues.BatteryScale, envValues.BatteryOffset)
+	s.Humidity = calibrateInt(s.Humidity, envValues.HumidityScale, envValues.HumidityOffset)
+	s.CO2 = calibrateInt(s.CO2, envValues.Co2Scale, envValues.Co2Offset)
+}
+
+func calibrateInt(v *int, scale, offset float64) *int {
+	if v == nil || (scale == 1 && offset == 0) {
+		return v
+	}
+	calibrated := int(math.Round(float64(*v)*scale + offset))
+	return &calibrated
+}
+
+// fillMissing replaces absent fields with zero values.
+func (s *MeterProCO2Status) fillMissing() {
+	if s.Temperature == nil {
+		s.Temperature = new(float64)
+	}
+	if s.Battery == nil {
+		s.Battery = new(int)
+		s.batteryFilled = true
+	}
+	if s.Humidity == nil {
+		s.Humidity = new(int)
+	}
+	if s.CO2 == nil {
+		s.CO2 = new(int)
+	}
+}
+
+// exitAuthError is the process exit code used when the SwitchBot API or a
+// sink rejects the configured credentials.
+const exitAuthError = 3
+
+// errAuthFailed marks a 401 or 403 response that outlived the one re-sign
+// after a signature rejection. Such failures will not go away on their own.
+var errAuthFailed = errors.New("authentication failed, check credentials")
+
+// authError returns an errAuthFailed error if statusCode is 401 or 403, and
+// nil otherwise.
+func authError(statusCode int, endpoint string) error {
+	if statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden {
+		return fmt.Errorf("%w: %s responded %d", errAuthFailed, endpoint, statusCode)
+	}
+	return nil
+}
+
+// roundTimestamp returns the reading with its timestamp rounded down per
+// TIMESTAMP_ROUND, leaving the original untouched.
+func roundTimestamp(status *MeterProCO2Status, envValues EnvValues) *MeterProCO2Status {
+	if envValues.TimestampRound <= 0 {
+		return status
+	}
+	rounded := *status
+	rounded.FetchedAt = status.FetchedAt.Truncate(envValues.TimestampRound)
+	return &rounded
+}
+
+// debugLogging enables debugf output. It is set from LOG_LEVEL at startup.
+var debugLogging bool
+
+func debugf(ctx context.Context, format string, v ...any) {
+	if debugLogging {
+		log.Printf("DEBUG [request_id=%s] "+format, append([]any{requestIDFrom(ctx)}, v...)...)
+	}
 }
 
 func main() {
-	var ev EnvValues
-	if err := envconfig.Process("", &ev); err != nil {
-		log.Fatal(err.Error())
+	configDump := flag.Bool("config-dump", false, "print the effective configuration as JSON with secrets redacted and exit")
+	bench := flag.Bool("bench", false, "run collect-and-push cycles and report fetch, format and push latency percentiles")
+	benchCount := flag.Int("count", 10, "number of cycles to run with -bench")
+	sample := flag.Bool("sample", false, "print a payload for a synthetic reading in the configured format and exit")
+	signDebug := flag.Bool("sign-debug", false, "print the signed status request for the configured device without sending it and exit")
+	var overrides ConfigOverrides
+	flag.StringVar(&overrides.Timestamp, "timestamp", "", "stamp emitted points with this RFC3339 time instead of the fetch time")
+	flag.StringVar(&overrides.Format, "format", "", "payload format, overriding FORMAT")
+	flag.StringVar(&overrides.LogLevel, "log-level", "", "log level, overriding LOG_LEVEL")
+	flag.StringVar(&overrides.DeviceID, "device-id", "", "device to collect from, overriding CO2_DEVICE_ID")
+	flag.BoolVar(&overrides.DryRun, "dry-run", false, "print metrics to stdout instead of sending them, overriding SINK")
+	flag.Parse()
+
+	ev, err := LoadConfig(overrides)
+
+	// A sample needs no device or credentials, only the formatting
+	// settings.
+	if *sample {
+		var errs ConfigErrors
+		if errors.As(err, &errs) {
+			err = nil
+			if remaining := errs.ignoreMissing("SWITCH_BOT_TOKEN", "SWITCH_BOT_CLIENT_SECRET", "CO2_DEVICE_ID", "PUSH_URL", "API_KEY", "DD_API_KEY", "ELASTICSEARCH_URL"); len(remaining) > 0 {
+				err = remaining
+			}
+		}
 	}
 
-	status, err := getMeterProCO2Status(&ev)
+	if *configDump {
+		if dumpErr := dumpConfig(os.Stdout, ev); dumpErr != nil {
+			log.Fatal(dumpErr)
+		}
+		if err == nil {
+			return
+		}
+	}
 	if err != nil {
-		fmt.Println("Error:", err)
-		log.Fatal(err)
+		log.Print(err)
+		os.Exit(exitConfigError)
 	}
 
-	metrics, err := formatMetrics(status, ev.Co2DeviceID)
-	if err != nil {
-		fmt.Println("Error formatting metrics:", err)
-		log.Fatal(err)
+	debugLogging = ev.LogLevel == "debug"
+
+	if *sample {
+		if err := printSample(os.Stdout, ev); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *signDebug {
+		if err := printSignedRequest(os.Stdout, ev); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	err = sendMetrics(metrics, ev)
+	client, err := newPushHTTPClient(ev)
 	if err != nil {
-		fmt.Println("Error sending metrics:", err)
-		log.Fatal(err)
+		log.Print(err)
+		os.Exit(exitConfigError)
 	}
+	pushHTTPClient = client
 
-	log.Println("Metrics sent successfully")
-}
+	if *bench {
+		if err := runBench(ev, *benchCount); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-func sendMetrics(metrics string, envValues EnvValues) error {
-	apiKey := envValues.APIKey
-	url := envValues.PushURL
+	if ev.Mode == "webhook" {
+		log.Fatal(runWebhookServer(ev))
+	}
 
-	bearer := "Bearer " + apiKey
+	ctx := withRequestID(context.Background(), newRequestID())
+	err = collect(ctx, ev)
 
-	fmt.Println(metrics)
-	byteStr := []byte(metrics)
+	// Self-metrics are pushed regardless of the collect outcome so that a
+	// missing heartbeat means the collector itself is down.
+	if ev.HeartbeatEnabled || ev.SelfMetricsEnabled {
+		if smErr := sendSelfMetrics(ctx, ev); smErr != nil {
+			cyclePrintln(ctx, "Error sending self-metrics:", smErr)
+		}
+	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(byteStr))
+	if errors.Is(err, errAuthFailed) {
+		log.Printf("[request_id=%s] %v", requestIDFrom(ctx), err)
+		os.Exit(exitAuthError)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		log.Fatalf("[request_id=%s] %v", requestIDFrom(ctx), err)
 	}
 
-	req.Header.Set("Content-Type", "text/plain")
-	req.Header.Set("Authorization", bearer)
+	log.Printf("[request_id=%s] Metrics sent successfully", requestIDFrom(ctx))
+}
+
+func collect(ctx context.Context, ev EnvValues) error {
+	start := time.Now()
+	defer func() { cycleDuration.Store(int64(time.Since(start))) }()
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	statuses, err := newSwitchBotClient(&ev).getMeterProCO2Statuses(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to send metrics: %w", err)
+		devicesPolled.Add(1)
+		cyclePrintln(ctx, "Error:", err)
+
+		// Keep the series continuous with placeholder values while the
+		// device can't be read. A failed fetch still fails the run.
+		if len(ev.OfflinePlaceholder) > 0 {
+			if pubErr := publish(ctx, offlineStatus(ev, time.Now()), ev); pubErr != nil {
+				return errors.Join(err, pubErr)
+			}
+		}
+		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+	return publishStatuses(ctx, statuses, ev)
+}
+
+// publishStatuses publishes each fetched reading. Unless
+// FAIL_ON_ANY_DEVICE_ERROR is set, failures are only logged as long as one
+// reading was delivered.
+func publishStatuses(ctx context.Context, statuses []*MeterProCO2Status, ev EnvValues) error {
+	var errs []error
+	delivered := 0
+	for _, status := range statuses {
+		if err := publishStatus(ctx, status, ev); err != nil {
+			errs = append(errs, err)
+		} else {
+			delivered++
+		}
+	}
+
+	err := errors.Join(errs...)
+	if err != nil && delivered > 0 && !ev.FailOnAnyDeviceError && !errors.Is(err, errAuthFailed) {
+		cyclePrintln(ctx, "Error publishing", len(errs), "of", len(statuses), "readings:", err)
 		return nil
-	} else {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("received non-2xx response: %d, body: %s", resp.StatusCode, string(body))
 	}
+	return err
 }
 
-func formatMetrics(status *MeterProCO2Status, deviceID string) (string, error) {
-	var metrics bytes.Buffer
+// publishStatus publishes one fetched reading, or its placeholder when the
+// device reports offline.
+func publishStatus(ctx context.Context, status *MeterProCO2Status, ev EnvValues) error {
+	devicesPolled.Add(1)
+	if status.DeviceID != "" {
+		ev.Co2DeviceID = status.DeviceID
+	}
+	if status.Quality == "ok" {
+		devicesOK.Add(1)
+	}
 
-	_, err := fmt.Fprintf(&metrics, "meterproco2_status,device_id=%s temperature=%f\n", deviceID, status.Temperature)
+	if len(ev.OfflinePlaceholder) > 0 && status.Quality == "offline" {
+		return publish(ctx, offlineStatus(ev, time.Now()), ev)
+	}
+	if !ev.Timestamp.IsZero() {
+		status.FetchedAt = ev.Timestamp
+	}
+
+	return publish(ctx, status, ev)
+}
+
+// publish sends a reading to the configured sink.
+func publish(ctx context.Context, status *MeterProCO2Status, envValues EnvValues) error {
+	err := publishReading(ctx, roundTimestamp(status, envValues), envValues)
 	if err != nil {
-		return "", err
+		publishesFailed.Add(1)
+	} else {
+		publishesOK.Add(1)
+	}
+	return err
+}
+
+func publishReading(ctx context.Context, status *MeterProCO2Status, envValues EnvValues) error {
+	if envValues.Sink == "datadog" {
+		if err := sendDatadogSeries(ctx, status, envValues); err != nil {
+			cyclePrintln(ctx, "Error sending metrics:", err)
+			return err
+		}
+		return nil
+	}
+	if envValues.Sink == "elasticsearch" {
+		if err := sendElasticsearchBulk(ctx, status, envValues); err != nil {
+			cyclePrintln(ctx, "Error sending metrics:", err)
+			return err
+		}
+		return nil
 	}
-	_, err = fmt.Fprintf(&metrics, "meterproco2_status,device_id=%s battery=%d\n", deviceID, status.Battery)
+
+	metrics, err := formatMetrics(status, envValues)
 	if err != nil {
-		return "", err
+		cyclePrintln(ctx, "Error formatting metrics:", err)
+		return err
 	}
-	_, err = fmt.Fprintf(&metrics, "meterproco2_status,device_id=%s humidity=%d\n", deviceID, status.Humidity)
+
+	err = emit(ctx, metrics, envValues)
 	if err != nil {
-		return "", err
+		cyclePrintln(ctx, "Error sending metrics:", err)
+		return err
+	}
+
+	return nil
+}
+
+// emit delivers formatted metrics to a text sink: stdout, a file, syslog, a
+// Unix socket, UDP or PUSH_URL.
+func emit(ctx context.Context, metrics string, envValues EnvValues) error {
+	switch envValues.Sink {
+	case "stdout":
+		_, err := fmt.Print(metrics)
+		return err
+	case "file":
+		return emitFile(metrics, envValues)
+	case "syslog":
+		return emitSyslog(metrics, envValues)
+	case "unix":
+		return emitUnixSocket(ctx, metrics, envValues)
+	case "udp":
+		return emitUDP(ctx, metrics, envValues)
+	default:
+		return sendMetrics(ctx, metrics, envValues)
+	}
+}
+
+func sendMetrics(ctx context.Context, metrics string, envValues EnvValues) error {
+	if envValues.Format != "protobuf" {
+		fmt.Println(metrics)
 	}
-	_, err = fmt.Fprintf(&metrics, "meterproco2_status,device_id=%s co2=%d\n", deviceID, status.CO2)
+
+	payloads, err := splitPayload(metrics, envValues.MaxPayloadBytes)
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	for _, payload := range payloads {
+		pushURL := envValues.PushURL
+		err := pushPayload(ctx, payload, envValues)
+		if err != nil && envValues.PushURLFallback != "" {
+			cyclePrintln(ctx, "Error pushing metrics, trying fallback:", err)
+			fallback := fallbackPushValues(envValues)
+			pushURL = fallback.PushURL
+			err = pushPayload(ctx, payload, fallback)
+		}
+		if err != nil {
+			return err
+		}
+		pushedBytes.Add(int64(len(payload)))
+		debugf(ctx, "Pushed %d bytes to %s", len(payload), pushURL)
 	}
 
-	return metrics.String(), nil
+	return nil
 }
 
-func generateSignature(t int64, token, secret, nonce string) (string, error) {
-	data := fmt.Sprintf("%s%d%s", token, t, nonce)
-	h := hmac.New(sha256.New, []byte(secret))
-	if _, err := h.Write([]byte(data)); err != nil {
-		return "", err
+// fallbackPushValues returns the settings for pushing to PUSH_URL_FALLBACK.
+func fallbackPushValues(envValues EnvValues) EnvValues {
+	envValues.PushURL = envValues.PushURLFallback
+	if envValues.PushFallbackAPIKey != "" {
+		envValues.APIKey = envValues.PushFallbackAPIKey
 	}
-	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+	return envValues
 }
 
-func getMeterProCO2Status(envValues *EnvValues) (*MeterProCO2Status, error) {
-	url := fmt.Sprintf("https://api.switch-bot.com/v1.1/devices/%s/status", envValues.Co2DeviceID)
-	nonce := "nonce"
-	t := time.Now().UnixMilli()
-	signature, err := generateSignature(t, envValues.SwitchBotToken, envValues.SwitchBotClientSecret, nonce)
+func pushPayload(ctx context.Context, payload string, envValues EnvValues) error {
+	apiKey := envValues.APIKey
+	url, err := expandPushURL(envValues.PushURL, envValues)
 	if err != nil {
-		fmt.Println("Error generating signature:", err)
+		return err
 	}
 
-	req, err := http.NewRequest("GET", url, nil)
+	bearer := "Bearer " + apiKey
+
+	byteStr := []byte(payload)
+
+	ctx, cancel := context.WithTimeout(ctx, envValues.HTTPTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, envValues.PushMethod, url, bytes.NewBuffer(byteStr))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Set("sign", signature)
-	req.Header.Set("nonce", nonce)
-	req.Header.Set("t", fmt.Sprintf("%d", t))
-	req.Header.Set("Authorization", envValues.SwitchBotToken)
+	req.Header.Set(requestIDHeader, requestIDFrom(ctx))
+	req.Header.Set("Content-Type", contentType(envValues.Format))
+	req.Header.Set("Authorization", bearer)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := pushHTTPClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return fmt.Errorf("failed to send metrics: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf("received non-2xx response: %d", resp.StatusCode)
+	// A 401 or 403 is an auth failure unless explicitly listed as success.
+	if slices.Contains(envValues.PushSuccessCodes, resp.StatusCode) {
+		return nil
+	}
+	if err := authError(resp.StatusCode, "push endpoint"); err != nil {
+		return err
+	}
+	if len(envValues.PushSuccessCodes) > 0 {
+		body, _ := readBody(resp.Body, envValues.MaxResponseBytes)
+		return fmt.Errorf("received unexpected response: %d, body: %s", resp.StatusCode, string(body))
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	} else {
+		body, _ := readBody(resp.Body, envValues.MaxResponseBytes)
+		return fmt.Errorf("received non-2xx response: %d, body: %s", resp.StatusCode, string(body))
+	}
+}
+
+// readBody reads at most limit bytes from r and fails if there is more.
+func readBody(r io.Reader, limit int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return body, err
+	}
+	if int64(len(body)) > limit {
+		return body[:limit], fmt.Errorf("response body exceeds limit of %d bytes", limit)
+	}
+	return body, nil
+}
+
+// splitPayload splits metrics into chunks of at most maxBytes, only ever
+// breaking between lines. A maxBytes of zero or less disables splitting.
+func splitPayload(metrics string, maxBytes int) ([]string, error) {
+	if maxBytes <= 0 || len(metrics) <= maxBytes {
+		return []string{metrics}, nil
 	}
 
-	var result struct {
-		StatusCode int `json:"statusCode"`
-		Body       struct {
-			Temperature float64 `json:"temperature"`
-			Battery     int     `json:"battery"`
-			Humidity    int     `json:"humidity"`
-			CO2         int     `json:"CO2"`
-		} `json:"body"`
-		Message string `json:"message"`
+	var payloads []string
+	var chunk strings.Builder
+	for _, line := range strings.SplitAfter(metrics, "\n") {
+		if line == "" {
+			continue
+		}
+		if len(line) > maxBytes {
+			return nil, fmt.Errorf("metric line of %d bytes exceeds max payload size of %d bytes", len(line), maxBytes)
+		}
+		if chunk.Len()+len(line) > maxBytes {
+			payloads = append(payloads, chunk.String())
+			chunk.Reset()
+		}
+		chunk.WriteString(line)
 	}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal response body: %w", err)
+	if chunk.Len() > 0 {
+		payloads = append(payloads, chunk.String())
 	}
 
-	return &MeterProCO2Status{
-		Temperature: result.Body.Temperature,
-		Battery:     result.Body.Battery,
-		Humidity:    result.Body.Humidity,
-		CO2:         result.Body.CO2,
-	}, nil
+	return payloads, nil
 }
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPushValues returns the settings pushPayload needs to push to url.
+func testPushValues(url string) EnvValues {
+	return EnvValues{
+		PushURL:          url,
+		APIKey:           "test-key",
+		PushMethod:       http.MethodPost,
+		HTTPTimeout:      5 * time.Second,
+		MaxResponseBytes: 1 << 20,
+	}
+}
+
+func TestPushPayloadNon2xx(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("database is locked"))
+	}))
+	defer server.Close()
+
+	err := pushPayload(context.Background(), "co2 value=400", testPushValues(server.URL))
+	if err == nil {
+		t.Fatal("pushPayload succeeded on a 500 response")
+	}
+	for _, want := range []string{"500", "database is locked"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+}
+
+func TestPushPayloadStatusBoundary(t *testing.T) {
+	tests := []struct {
+		status  int
+		wantErr bool
+	}{
+		{200, false},
+		{299, false},
+		{300, true},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+		err := pushPayload(context.Background(), "co2 value=400", testPushValues(server.URL))
+		server.Close()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("status %d: err = %v, want error %v", tt.status, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSplitPayload(t *testing.T) {
+	metrics := "aaaa\nbbbb\ncc\n"
+	tests := []struct {
+		maxBytes int
+		want     []string
+		wantErr  bool
+	}{
+		{0, []string{metrics}, false},
+		{len(metrics), []string{metrics}, false},
+		{10, []string{"aaaa\nbbbb\n", "cc\n"}, false},
+		{9, []string{"aaaa\n", "bbbb\ncc\n"}, false},
+		{5, []string{"aaaa\n", "bbbb\n", "cc\n"}, false},
+		{4, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := splitPayload(metrics, tt.maxBytes)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("splitPayload(%d): err = %v, want error %v", tt.maxBytes, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("splitPayload(%d) = %q, want %q", tt.maxBytes, got, tt.want)
+		}
+	}
+}
+
+func TestPushPayloadMethod(t *testing.T) {
+	for _, method := range []string{http.MethodPost, http.MethodPut} {
+		var got string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r.Method
+		}))
+		ev := testPushValues(server.URL)
+		ev.PushMethod = method
+		err := pushPayload(context.Background(), "co2 value=400", ev)
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: %v", method, err)
+		}
+		if got != method {
+			t.Errorf("pushed with %s, want %s", got, method)
+		}
+	}
+}
+
+func TestPushPayloadSuccessCodes(t *testing.T) {
+	tests := []struct {
+		codes   []int
+		status  int
+		wantErr bool
+	}{
+		{[]int{200}, 200, false},
+		{[]int{200}, 202, true},
+		{[]int{200, 409}, 409, false},
+		{[]int{200, 409}, 500, true},
+		{[]int{200, 403}, 403, false},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+		ev := testPushValues(server.URL)
+		ev.PushSuccessCodes = tt.codes
+		err := pushPayload(context.Background(), "co2 value=400", ev)
+		server.Close()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("codes %v, status %d: err = %v, want error %v", tt.codes, tt.status, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	ev := testEnvValues(t, map[string]string{
+		"TEMPERATURE_SCALE":  "0.5",
+		"TEMPERATURE_OFFSET": "1",
+		"BATTERY_OFFSET":     "5",
+		"HUMIDITY_SCALE":     "1.1",
+		"CO2_OFFSET":         "-40",
+	})
+	status := testStatus()
+	status.calibrate(ev)
+
+	if got, want := *status.Temperature, 21.5*0.5+1; got != want {
+		t.Errorf("Temperature = %v, want %v", got, want)
+	}
+	if got, want := *status.Battery, 95; got != want {
+		t.Errorf("Battery = %d, want %d", got, want)
+	}
+	// 45 * 1.1 = 49.5, rounded to the nearest integer.
+	if got, want := *status.Humidity, 50; got != want {
+		t.Errorf("Humidity = %d, want %d", got, want)
+	}
+	if got, want := *status.CO2, 772; got != want {
+		t.Errorf("CO2 = %d, want %d", got, want)
+	}
+}
+
+func TestCalibrateDefaultsAndAbsentFields(t *testing.T) {
+	ev := testEnvValues(t, map[string]string{"CO2_OFFSET": "-40"})
+	status := testStatus()
+	status.Humidity = nil
+	status.calibrate(ev)
+
+	if got := *status.Temperature; got != 21.5 {
+		t.Errorf("Temperature = %v, want it unchanged", got)
+	}
+	if status.Humidity != nil {
+		t.Errorf("Humidity = %d, want it to stay absent", *status.Humidity)
+	}
+	if got := *status.CO2; got != 772 {
+		t.Errorf("CO2 = %d, want 772", got)
+	}
+}
+
+func TestSendMetricsFallback(t *testing.T) {
+	tests := []struct {
+		name          string
+		primaryStatus int
+		wantFallback  bool
+	}{
+		{"primary succeeds", http.StatusOK, false},
+		{"primary fails", http.StatusServiceUnavailable, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.primaryStatus)
+			}))
+			defer primary.Close()
+
+			var fallbackAuth string
+			fallbackCalled := false
+			fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fallbackCalled = true
+				fallbackAuth = r.Header.Get("Authorization")
+			}))
+			defer fallback.Close()
+
+			ev := testPushValues(primary.URL)
+			ev.PushURLFallback = fallback.URL
+			ev.PushFallbackAPIKey = "fallback-key"
+			if err := sendMetrics(context.Background(), "co2 value=400\n", ev); err != nil {
+				t.Fatal(err)
+			}
+			if fallbackCalled != tt.wantFallback {
+				t.Errorf("fallback called = %v, want %v", fallbackCalled, tt.wantFallback)
+			}
+			if tt.wantFallback && fallbackAuth != "Bearer fallback-key" {
+				t.Errorf("fallback Authorization = %q, want the fallback key", fallbackAuth)
+			}
+		})
+	}
+}
+
+func TestSendMetricsFallbackFails(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	ev := testPushValues(failing.URL)
+	ev.PushURLFallback = failing.URL
+	if err := sendMetrics(context.Background(), "co2 value=400\n", ev); err == nil {
+		t.Error("sendMetrics succeeded with both endpoints failing")
+	}
+}
+
+func TestPublishStatusesPartialFailure(t *testing.T) {
+	// Readings for device BAD fail to push; all others succeed.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/BAD") {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	reading := func(deviceID string) *MeterProCO2Status {
+		status := testStatus()
+		status.DeviceID = deviceID
+		return status
+	}
+	tests := []struct {
+		name      string
+		failOnAny string
+		devices   []string
+		wantErr   bool
+	}{
+		{"fail on any, partial failure", "true", []string{"GOOD", "BAD"}, true},
+		{"tolerate, partial failure", "false", []string{"GOOD", "BAD"}, false},
+		{"tolerate, all failed", "false", []string{"BAD", "BAD"}, true},
+		{"fail on any, all delivered", "true", []string{"GOOD", "GOOD"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetRunCounters(t)
+			ev := testEnvValues(t, map[string]string{
+				"SINK":                     "push",
+				"PUSH_URL":                 server.URL + "/{device_id}",
+				"API_KEY":                  "test-key",
+				"FAIL_ON_ANY_DEVICE_ERROR": tt.failOnAny,
+			})
+			var statuses []*MeterProCO2Status
+			for _, id := range tt.devices {
+				statuses = append(statuses, reading(id))
+			}
+
+			err := publishStatuses(context.Background(), statuses, ev)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPushPayloadUnauthorized(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	err := pushPayload(context.Background(), "co2 value=400", testPushValues(server.URL))
+	if !errors.Is(err, errAuthFailed) {
+		t.Errorf("error = %v, want errAuthFailed", err)
+	}
+}
+
+func TestRoundTimestamp(t *testing.T) {
+	fetchedAt := time.Date(2024, 5, 1, 12, 34, 56, 789, time.UTC)
+	tests := []struct {
+		round time.Duration
+		want  time.Time
+	}{
+		{0, fetchedAt},
+		{time.Minute, time.Date(2024, 5, 1, 12, 34, 0, 0, time.UTC)},
+		{time.Hour, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		status := testStatus()
+		status.FetchedAt = fetchedAt
+		rounded := roundTimestamp(status, EnvValues{TimestampRound: tt.round})
+		if !rounded.FetchedAt.Equal(tt.want) {
+			t.Errorf("round %s: FetchedAt = %s, want %s", tt.round, rounded.FetchedAt, tt.want)
+		}
+		if !status.FetchedAt.Equal(fetchedAt) {
+			t.Errorf("round %s: original reading changed to %s", tt.round, status.FetchedAt)
+		}
+	}
+}
+
+func TestTimestampRoundImpliesEmitTimestamp(t *testing.T) {
+	ev := testEnvValues(t, map[string]string{"TIMESTAMP_ROUND": "1m"})
+	if !ev.EmitTimestamp {
+		t.Fatal("TIMESTAMP_ROUND did not set EmitTimestamp")
+	}
+
+	status := testStatus()
+	status.FetchedAt = time.Date(2024, 5, 1, 12, 34, 56, 0, time.UTC)
+	metrics, err := formatMetrics(roundTimestamp(status, ev), ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf(" co2=812 %d\n", time.Date(2024, 5, 1, 12, 34, 0, 0, time.UTC).UnixNano())
+	if !strings.HasSuffix(metrics, want) {
+		t.Errorf("metrics =\n%s\nwant the last line to end with %q", metrics, want)
+	}
+}
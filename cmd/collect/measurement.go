@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// measurementNamePattern is the character set accepted by every payload
+// format for measurement and metric names.
+var measurementNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// unsafeNameChars matches runs of characters substituted values may not
+// carry into a measurement name.
+var unsafeNameChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// validateMeasurementTemplate checks that every placeholder in
+// MEASUREMENT_TEMPLATE is known and that the rest is a valid name.
+func validateMeasurementTemplate(envValues EnvValues) error {
+	for _, m := range pushURLPlaceholder.FindAllStringSubmatch(envValues.MeasurementTemplate, -1) {
+		switch m[1] {
+		case "device_id", "device_type", "device_name":
+		default:
+			return fmt.Errorf("unknown placeholder %s: must be {device_id}, {device_type} or {device_name}", m[0])
+		}
+	}
+
+	literal := pushURLPlaceholder.ReplaceAllString(envValues.MeasurementTemplate, "x")
+	if !measurementNamePattern.MatchString(literal) {
+		return fmt.Errorf("%q must contain only letters, digits and underscores and not start with a digit", envValues.MeasurementTemplate)
+	}
+	return nil
+}
+
+// measurementName expands MEASUREMENT_TEMPLATE for a reading. Substituted
+// values are lowercased with other characters collapsed to underscores, so
+// "MeterPro(CO2)" becomes "meterpro_co2". An attribute that is not known,
+// such as the device type of a placeholder reading, becomes "unknown".
+func measurementName(status *MeterProCO2Status, envValues EnvValues) string {
+	return pushURLPlaceholder.ReplaceAllStringFunc(envValues.MeasurementTemplate, func(placeholder string) string {
+		var value string
+		switch placeholder {
+		case "{device_id}":
+			value = envValues.Co2DeviceID
+		case "{device_type}":
+			value = status.DeviceType
+		case "{device_name}":
+			value = envValues.Co2DeviceName
+		}
+
+		value = strings.Trim(unsafeNameChars.ReplaceAllString(strings.ToLower(value), "_"), "_")
+		if value == "" {
+			return "unknown"
+		}
+		return value
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// offlineStatus builds the placeholder reading pushed instead of a real one
+// when the device cannot be read. Only fields with a configured placeholder
+// are set.
+func offlineStatus(envValues EnvValues, t time.Time) *MeterProCO2Status {
+	status := &MeterProCO2Status{
+		FetchedAt: t,
+		Quality:   "offline",
+		Offline:   true,
+	}
+	for name, value := range envValues.OfflinePlaceholder {
+		switch name {
+		case "temperature":
+			status.Temperature = &value
+		case "battery":
+			v := int(value)
+			status.Battery = &v
+		case "humidity":
+			v := int(value)
+			status.Humidity = &v
+		case "co2":
+			v := int(value)
+			status.CO2 = &v
+		}
+	}
+	return status
+}
+
+// validateOfflinePlaceholder checks that a placeholder targets a known field
+// and, for integer fields, is a whole number.
+func validateOfflinePlaceholder(name string, value float64) bool {
+	switch name {
+	case "temperature":
+		return true
+	case "battery", "humidity", "co2":
+		return value == math.Trunc(value)
+	default:
+		return false
+	}
+}
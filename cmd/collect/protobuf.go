@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Protobuf wire types used by the metricferry.proto messages.
+const (
+	wireVarint = 0
+	wireI64    = 1
+	wireLen    = 2
+)
+
+// formatProtobuf encodes points as a metricferry.Batch message, as defined
+// in metricferry.proto.
+func formatProtobuf(points []point) string {
+	var batch []byte
+	for _, p := range points {
+		batch = appendLenField(batch, 1, encodeProtobufPoint(p))
+	}
+	return string(batch)
+}
+
+// encodeProtobufPoint encodes a metricferry.Point message. Fields holding
+// their zero value are omitted, as proto3 does.
+func encodeProtobufPoint(p point) []byte {
+	var b []byte
+	b = appendStringField(b, 1, p.measurement)
+	for _, t := range p.tags {
+		var entry []byte
+		entry = appendStringField(entry, 1, t.key)
+		entry = appendStringField(entry, 2, t.value)
+		b = appendLenField(b, 2, entry)
+	}
+	b = appendStringField(b, 3, p.field.name)
+
+	// Members of the value oneof are written even when zero, so that the
+	// set member is known.
+	switch v := p.field.value.(type) {
+	case float64:
+		b = protowireTag(b, 4, wireI64)
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	case int:
+		b = protowireTag(b, 5, wireVarint)
+		b = binary.AppendUvarint(b, uint64(v))
+	case string:
+		b = appendLenField(b, 6, []byte(v))
+	}
+
+	if !p.time.IsZero() {
+		b = protowireTag(b, 7, wireVarint)
+		b = binary.AppendUvarint(b, uint64(p.time.UnixNano()))
+	}
+	b = appendStringField(b, 8, p.field.unit)
+	return b
+}
+
+func protowireTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func appendLenField(b []byte, field int, value []byte) []byte {
+	b = protowireTag(b, field, wireLen)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func appendStringField(b []byte, field int, value string) []byte {
+	if value == "" {
+		return b
+	}
+	return appendLenField(b, field, []byte(value))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+)
+
+// pushHTTPClient is used for requests to PUSH_URL. It is replaced at
+// startup once the push TLS settings have been loaded.
+var pushHTTPClient = &http.Client{}
+
+var pushURLPlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// validatePushURLTemplate checks that every placeholder in a push URL is
+// known and can be resolved.
+func validatePushURLTemplate(template string, envValues EnvValues) error {
+	for _, m := range pushURLPlaceholder.FindAllStringSubmatch(template, -1) {
+		switch m[1] {
+		case "device_id", "host":
+		case "device_name":
+			if envValues.Co2DeviceName == "" {
+				return errors.New("{device_name} requires CO2_DEVICE_NAME to be set")
+			}
+		default:
+			return fmt.Errorf("unknown placeholder %s: must be {device_id}, {device_name} or {host}", m[0])
+		}
+	}
+	return nil
+}
+
+// expandPushURL substitutes the placeholders in a push URL template.
+func expandPushURL(template string, envValues EnvValues) (string, error) {
+	var expandErr error
+	expanded := pushURLPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		var value string
+		switch placeholder {
+		case "{device_id}":
+			value = envValues.Co2DeviceID
+		case "{device_name}":
+			value = envValues.Co2DeviceName
+		case "{host}":
+			host, err := os.Hostname()
+			if err != nil {
+				expandErr = fmt.Errorf("failed to get hostname: %w", err)
+			}
+			value = host
+		}
+		return url.PathEscape(value)
+	})
+	return expanded, expandErr
+}
+
+// newPushHTTPClient builds the client for the push endpoint, loading the
+// client certificate for mutual TLS when one is configured.
+func newPushHTTPClient(envValues EnvValues) (*http.Client, error) {
+	client := &http.Client{CheckRedirect: pushRedirectPolicy(envValues.PushRedirectPolicy)}
+
+	certFile, keyFile := envValues.PushClientCertFile, envValues.PushClientKeyFile
+	if certFile == "" && keyFile == "" {
+		return client, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("PUSH_CLIENT_CERT_FILE and PUSH_CLIENT_KEY_FILE must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load push client certificate: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	client.Transport = transport
+
+	return client, nil
+}
+
+// pushRedirectPolicy returns the CheckRedirect function for a
+// PUSH_REDIRECT_POLICY value:
+//
+//   - "same-host" follows redirects and keeps the Authorization header only
+//     while the redirect stays on the original host.
+//   - "reauth" follows redirects and always re-attaches the Authorization
+//     header, including across hosts.
+//   - "none" does not follow redirects, so the 3xx is reported as a failed
+//     push.
+func pushRedirectPolicy(policy string) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if policy == "none" {
+			return http.ErrUseLastResponse
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+
+		auth := via[0].Header.Get("Authorization")
+		if policy == "reauth" || req.URL.Host == via[0].URL.Host {
+			req.Header.Set("Authorization", auth)
+		} else {
+			req.Header.Del("Authorization")
+		}
+		return nil
+	}
+}
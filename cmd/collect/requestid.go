@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// requestIDHeader carries the cycle's request ID on outgoing requests so a
+// push can be correlated with the fetch it originated from.
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// newRequestID returns a fresh random ID for a collect cycle.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// cyclePrintln prints a line prefixed with the cycle's request ID.
+func cyclePrintln(ctx context.Context, a ...any) {
+	fmt.Println(append([]any{"[request_id=" + requestIDFrom(ctx) + "]"}, a...)...)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// sampleStatus returns a fixed, plausible reading for -sample.
+func sampleStatus(t time.Time) *MeterProCO2Status {
+	temperature, battery, humidity, co2 := 23.4, 100, 45, 812
+	return &MeterProCO2Status{
+		Temperature: &temperature,
+		Battery:     &battery,
+		Humidity:    &humidity,
+		CO2:         &co2,
+		FetchedAt:   t,
+		Quality:     "ok",
+		DeviceType:  "MeterPro(CO2)",
+	}
+}
+
+// printSample writes the payload the configured sink would receive for a
+// synthetic reading. No network requests are made.
+func printSample(w io.Writer, envValues EnvValues) error {
+	if envValues.Co2DeviceID == "" {
+		envValues.Co2DeviceID = "SAMPLE"
+	}
+
+	t := time.Now()
+	if !envValues.Timestamp.IsZero() {
+		t = envValues.Timestamp
+	}
+	status := roundTimestamp(sampleStatus(t), envValues)
+
+	if envValues.Sink == "datadog" {
+		payload, err := marshalDatadogSeries(status, envValues)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(payload))
+		return err
+	}
+	if envValues.Sink == "elasticsearch" {
+		payload, err := marshalElasticsearchBulk(status, envValues)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(payload)
+		return err
+	}
+
+	metrics, err := formatMetrics(status, envValues)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(w, metrics)
+	return err
+}
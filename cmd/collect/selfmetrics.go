@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// pushedBytes counts the payload bytes successfully pushed by
+	// sendMetrics.
+	pushedBytes atomic.Int64
+	// cycleDuration is how long the last collect took, from its start to
+	// the completion of its data push, in nanoseconds.
+	cycleDuration atomic.Int64
+	// devicesPolled and devicesOK count device fetches, and those that
+	// returned an ok reading.
+	devicesPolled atomic.Int64
+	devicesOK     atomic.Int64
+	// publishesOK and publishesFailed count readings delivered to the sink.
+	publishesOK     atomic.Int64
+	publishesFailed atomic.Int64
+	// apiQuotaRemaining is the latest remaining request count reported by
+	// the SwitchBot API, valid once apiQuotaSeen is set.
+	apiQuotaRemaining atomic.Int64
+	apiQuotaSeen      atomic.Bool
+)
+
+// apiResponses counts SwitchBot API responses by HTTP status class
+// (http_class=2xx) and by body statusCode (status_code=100), in the order
+// first seen. Each response is counted once per label, so the two are
+// reported as separate metrics, metric_ferry_api_responses_by_http_class
+// and metric_ferry_api_responses_by_status_code.
+var apiResponses struct {
+	sync.Mutex
+	counts map[tag]int
+	order  []tag
+}
+
+// countAPIResponse records one SwitchBot API response under t.
+func countAPIResponse(t tag) {
+	apiResponses.Lock()
+	defer apiResponses.Unlock()
+
+	if apiResponses.counts == nil {
+		apiResponses.counts = make(map[tag]int)
+	}
+	if _, ok := apiResponses.counts[t]; !ok {
+		apiResponses.order = append(apiResponses.order, t)
+	}
+	apiResponses.counts[t]++
+}
+
+// sendSelfMetrics pushes the enabled metrics about the collector itself,
+// tagged with the collector host.
+func sendSelfMetrics(ctx context.Context, envValues EnvValues) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get hostname: %w", err)
+	}
+	tags := []tag{{"host", host}}
+
+	var points []point
+	if envValues.HeartbeatEnabled {
+		points = append(points, point{
+			measurement: "metric_ferry_heartbeat",
+			tags:        tags,
+			field:       metricField{name: "value", value: 1},
+		})
+	}
+	if envValues.SelfMetricsEnabled {
+		points = append(points, point{
+			measurement: "metric_ferry_push_bytes",
+			tags:        tags,
+			field:       metricField{name: "value", value: int(pushedBytes.Load()), unit: "bytes"},
+		})
+		points = append(points, point{
+			measurement: "metric_ferry_cycle_duration_seconds",
+			tags:        tags,
+			field:       metricField{name: "value", value: time.Duration(cycleDuration.Load()).Seconds(), unit: "seconds"},
+		})
+		for _, f := range healthFields() {
+			points = append(points, point{
+				measurement: "metric_ferry_health",
+				tags:        tags,
+				field:       f,
+			})
+		}
+		points = append(points, point{
+			measurement: "metric_ferry_build_info",
+			tags:        append(slices.Clip(tags), tag{"version", version}, tag{"commit", buildCommit()}),
+			field:       metricField{name: "value", value: 1},
+		})
+		apiResponses.Lock()
+		for _, t := range apiResponses.order {
+			points = append(points, point{
+				measurement: "metric_ferry_api_responses_by_" + t.key,
+				tags:        append(slices.Clip(tags), t),
+				field:       metricField{name: "value", value: apiResponses.counts[t]},
+			})
+		}
+		apiResponses.Unlock()
+		if apiQuotaSeen.Load() {
+			points = append(points, point{
+				measurement: "metric_ferry_api_quota_remaining",
+				tags:        tags,
+				field:       metricField{name: "value", value: int(apiQuotaRemaining.Load())},
+			})
+		}
+	}
+
+	metrics, err := renderPoints(points, envValues)
+	if err != nil {
+		return err
+	}
+
+	return emit(ctx, metrics, envValues)
+}
+
+// healthFields summarizes the run for metric_ferry_health:
+//
+//   - devices_total: devices fetched this run.
+//   - devices_ok: devices that returned an ok reading.
+//   - push_ok: 1 if at least one reading was delivered and none failed,
+//     0 otherwise.
+func healthFields() []metricField {
+	pushOK := 0
+	if publishesOK.Load() > 0 && publishesFailed.Load() == 0 {
+		pushOK = 1
+	}
+	return []metricField{
+		{name: "devices_total", value: int(devicesPolled.Load())},
+		{name: "devices_ok", value: int(devicesOK.Load())},
+		{name: "push_ok", value: pushOK},
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendSelfMetricsCycleDuration(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer server.Close()
+
+	ev := testEnvValues(t, map[string]string{
+		"SINK":                 "push",
+		"PUSH_URL":             server.URL,
+		"API_KEY":              "test-key",
+		"SELF_METRICS_ENABLED": "true",
+	})
+	cycleDuration.Store(int64(1500 * time.Millisecond))
+	t.Cleanup(func() { cycleDuration.Store(0) })
+
+	if err := sendSelfMetrics(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body, "metric_ferry_cycle_duration_seconds,host=") || !strings.Contains(body, " value=1.500000\n") {
+		t.Errorf("cycle duration missing from self-metrics:\n%s", body)
+	}
+}
+
+// resetRunCounters zeroes the per-run counters when the test ends.
+func resetRunCounters(t *testing.T) {
+	t.Cleanup(func() {
+		devicesPolled.Store(0)
+		devicesOK.Store(0)
+		publishesOK.Store(0)
+		publishesFailed.Store(0)
+	})
+}
+
+func TestHealthFields(t *testing.T) {
+	tests := []struct {
+		name                          string
+		polled, ok, published, failed int64
+		want                          map[string]int
+	}{
+		{"all delivered", 2, 2, 2, 0, map[string]int{"devices_total": 2, "devices_ok": 2, "push_ok": 1}},
+		{"one device not ok", 3, 2, 3, 0, map[string]int{"devices_total": 3, "devices_ok": 2, "push_ok": 1}},
+		{"one publish failed", 3, 3, 2, 1, map[string]int{"devices_total": 3, "devices_ok": 3, "push_ok": 0}},
+		{"nothing delivered", 1, 0, 0, 0, map[string]int{"devices_total": 1, "devices_ok": 0, "push_ok": 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetRunCounters(t)
+			devicesPolled.Store(tt.polled)
+			devicesOK.Store(tt.ok)
+			publishesOK.Store(tt.published)
+			publishesFailed.Store(tt.failed)
+
+			fields := healthFields()
+			for name, want := range tt.want {
+				if got, _ := fieldValue(fields, name); got != want {
+					t.Errorf("%s = %v, want %d", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSendSelfMetricsAPIResponses(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer server.Close()
+
+	ev := testEnvValues(t, map[string]string{
+		"SINK":                 "push",
+		"PUSH_URL":             server.URL,
+		"API_KEY":              "test-key",
+		"SELF_METRICS_ENABLED": "true",
+	})
+	t.Cleanup(func() {
+		apiResponses.Lock()
+		apiResponses.counts, apiResponses.order = nil, nil
+		apiResponses.Unlock()
+	})
+	for range 2 {
+		countAPIResponse(tag{"http_class", "2xx"})
+		countAPIResponse(tag{"status_code", "100"})
+	}
+
+	if err := sendSelfMetrics(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"metric_ferry_api_responses_by_http_class,host=",
+		",http_class=2xx value=2\n",
+		"metric_ferry_api_responses_by_status_code,host=",
+		",status_code=100 value=2\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("self-metrics missing %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "metric_ferry_api_responses,") {
+		t.Errorf("responses counted under a single metric:\n%s", body)
+	}
+}
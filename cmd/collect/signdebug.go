@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// printSignedRequest writes the method, URL and headers of the status
+// request for the configured device, signed as it would be sent. Nothing is
+// sent. The token is masked; the client secret only contributes to the
+// signature and is never written.
+func printSignedRequest(w io.Writer, envValues EnvValues) error {
+	req, err := http.NewRequestWithContext(context.Background(), "GET", statusURL(envValues.Co2DeviceID), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	newSwitchBotClient(&envValues).sign(req)
+
+	if _, err := fmt.Fprintln(w, req.Method, req.URL); err != nil {
+		return err
+	}
+	for _, name := range []string{"Authorization", "sign", "nonce", "t"} {
+		value := req.Header.Get(name)
+		if name == "Authorization" {
+			value = maskToken(value)
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s\n", name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maskToken hides all but the last four characters of a token, enough to
+// tell tokens apart.
+func maskToken(token string) string {
+	if len(token) <= 8 {
+		return strings.Repeat("*", len(token))
+	}
+	return strings.Repeat("*", len(token)-4) + token[len(token)-4:]
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// decimalFloat is a float64 that also accepts a JSON string using either
+// "." or "," as the decimal separator, as some locales report temperature
+// as "23,4".
+type decimalFloat float64
+
+func (f *decimalFloat) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = strings.TrimSpace(unquoted)
+		if !strings.Contains(s, ".") {
+			s = strings.Replace(s, ",", ".", 1)
+		}
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid decimal %s: %w", b, err)
+	}
+	*f = decimalFloat(v)
+	return nil
+}
+
+func generateSignature(t int64, token, secret, nonce string) (string, error) {
+	data := fmt.Sprintf("%s%d%s", token, t, nonce)
+	h := hmac.New(sha256.New, []byte(secret))
+	if _, err := h.Write([]byte(data)); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// statusURL returns the SwitchBot API endpoint for a device's status.
+func statusURL(deviceID string) string {
+	return fmt.Sprintf("https://api.switch-bot.com/v1.1/devices/%s/status", deviceID)
+}
+
+// switchBotClient talks to the SwitchBot API on behalf of the configured
+// account.
+type switchBotClient struct {
+	envValues  *EnvValues
+	httpClient *http.Client
+	// now and nonce are the time and nonce sources used when signing
+	// requests.
+	now   func() time.Time
+	nonce func() string
+	// clockOffset corrects signing timestamps for a server clock found to
+	// disagree with ours. See isSignatureRejection.
+	clockOffset time.Duration
+}
+
+func newSwitchBotClient(envValues *EnvValues) *switchBotClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = envValues.SwitchBotMaxIdleConnsPerHost
+	transport.MaxConnsPerHost = envValues.SwitchBotMaxConnsPerHost
+
+	return &switchBotClient{
+		envValues:  envValues,
+		httpClient: &http.Client{Transport: transport},
+		now:        time.Now,
+		nonce:      newNonce,
+	}
+}
+
+// sign sets the authentication headers required by the SwitchBot API and
+// returns the signing time. Each call uses a fresh timestamp and nonce.
+func (c *switchBotClient) sign(req *http.Request) time.Time {
+	nonce := c.nonce()
+	signedAt := c.now().Add(c.clockOffset)
+	t := signedAt.UnixMilli()
+	signature, err := generateSignature(t, c.envValues.SwitchBotToken, c.envValues.SwitchBotClientSecret, nonce)
+	if err != nil {
+		fmt.Println("Error generating signature:", err)
+	}
+
+	req.Header.Set("sign", signature)
+	req.Header.Set("nonce", nonce)
+	req.Header.Set("t", fmt.Sprintf("%d", t))
+	req.Header.Set("Authorization", c.envValues.SwitchBotToken)
+
+	// Only the per-request values are logged, for correlating with
+	// SwitchBot-side rejections; the token and secret never are.
+	debugf(req.Context(), "Signed request with nonce=%s t=%d", nonce, t)
+	return signedAt
+}
+
+// switchBotResponse is a response to a signed request.
+type switchBotResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+	// signedAt is the timestamp the request was signed with.
+	signedAt time.Time
+}
+
+// get sends a signed GET request and returns the response.
+func (c *switchBotClient) get(ctx context.Context, url string) (*switchBotResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.envValues.HTTPTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	signedAt := c.sign(req)
+	req.Header.Set(requestIDHeader, requestIDFrom(ctx))
+	if c.envValues.SwitchBotAcceptGzip {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	recordRateLimit(ctx, resp.Header)
+	countAPIResponse(tag{"http_class", fmt.Sprintf("%dxx", resp.StatusCode/100)})
+
+	// The transport only decodes gzip itself when it set Accept-Encoding;
+	// with the header set explicitly, decoding is up to us. The response
+	// size limit applies to the decoded body.
+	var r io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode gzip response: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	body, err := readBody(r, c.envValues.MaxResponseBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	return &switchBotResponse{
+		statusCode: resp.StatusCode,
+		header:     resp.Header,
+		body:       body,
+		signedAt:   signedAt,
+	}, nil
+}
+
+// recordRateLimit logs any rate limit headers on a SwitchBot response and
+// keeps the remaining request count for metric_ferry_api_quota_remaining.
+// SwitchBot does not document these headers, so any X-RateLimit-* or
+// RateLimit-* header is accepted.
+func recordRateLimit(ctx context.Context, header http.Header) {
+	for name, values := range header {
+		lower := strings.ToLower(name)
+		if !strings.HasPrefix(lower, "x-ratelimit-") && !strings.HasPrefix(lower, "ratelimit-") {
+			continue
+		}
+		debugf(ctx, "Rate limit header %s: %s", name, strings.Join(values, ", "))
+
+		if strings.HasSuffix(lower, "-remaining") {
+			if remaining, err := strconv.ParseInt(values[0], 10, 64); err == nil {
+				apiQuotaRemaining.Store(remaining)
+				apiQuotaSeen.Store(true)
+			}
+		}
+	}
+}
+
+// bodySnippetBytes bounds how much of an unexpected response body is quoted
+// in errors.
+const bodySnippetBytes = 200
+
+// bodySnippet returns the start of a response body with whitespace
+// collapsed, for quoting in errors.
+func bodySnippet(body []byte) string {
+	s := strings.Join(strings.Fields(string(body)), " ")
+	if len(s) > bodySnippetBytes {
+		return s[:bodySnippetBytes] + "..."
+	}
+	return s
+}
+
+// maxSignatureSkew is how far the server clock may be from the signing
+// timestamp before a rejection is put down to the timestamp.
+const maxSignatureSkew = 5 * time.Second
+
+// isSignatureRejection reports whether a response is SwitchBot rejecting the
+// request timestamp, returning the server's clock offset from the signing
+// time. SwitchBot answers a stale timestamp and wrong credentials alike,
+// with a 401 whose body is exactly {"message":"Unauthorized"}, so only such
+// a response whose Date header is more than maxSignatureSkew from the
+// signing time counts; anything else is a credentials problem and must not
+// be retried.
+func isSignatureRejection(resp *switchBotResponse) (time.Duration, bool) {
+	if resp.statusCode != http.StatusUnauthorized {
+		return 0, false
+	}
+
+	var result struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(resp.body, &result); err != nil || result.Message != "Unauthorized" {
+		return 0, false
+	}
+
+	serverTime, err := http.ParseTime(resp.header.Get("Date"))
+	if err != nil {
+		return 0, false
+	}
+	offset := serverTime.Sub(resp.signedAt)
+	if offset.Abs() <= maxSignatureSkew {
+		return 0, false
+	}
+	return offset, true
+}
+
+func (c *switchBotClient) getMeterProCO2Status(ctx context.Context) (*MeterProCO2Status, error) {
+	statuses, err := c.getMeterProCO2Statuses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return statuses[0], nil
+}
+
+// statusBody is a device status as found in the body of a status response.
+type statusBody struct {
+	DeviceID    string        `json:"deviceId"`
+	Temperature *decimalFloat `json:"temperature"`
+	Battery     *int          `json:"battery"`
+	Humidity    *int          `json:"humidity"`
+	CO2         *int          `json:"CO2"`
+	Version     string        `json:"version"`
+	DeviceType  string        `json:"deviceType"`
+	RSSI        *int          `json:"rssi"`
+}
+
+// getMeterProCO2Statuses fetches the device status. The response body is
+// normally a single status object, but a list of statuses is also accepted
+// and yields one reading per entry, each carrying the entry's deviceId.
+func (c *switchBotClient) getMeterProCO2Statuses(ctx context.Context) ([]*MeterProCO2Status, error) {
+	envValues := c.envValues
+	url := statusURL(envValues.Co2DeviceID)
+
+	resp, err := c.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	// A signature can be rejected when the timestamp disagrees with the
+	// server clock, so re-sign once with a fresh nonce and a timestamp
+	// corrected to the server's clock.
+	if offset, ok := isSignatureRejection(resp); ok {
+		debugf(ctx, "Signature rejected with server clock %s off, retrying with a corrected timestamp and fresh nonce", offset)
+		c.clockOffset += offset
+		resp, err = c.get(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+	}
+	statusCode, body := resp.statusCode, resp.body
+
+	if err := authError(statusCode, "SwitchBot API"); err != nil {
+		return nil, err
+	}
+	// Gateways in front of the API can answer with an HTML error page.
+	if !json.Valid(body) {
+		return nil, fmt.Errorf("received non-JSON response: %d, body: %s", statusCode, bodySnippet(body))
+	}
+	if statusCode >= 400 {
+		return nil, fmt.Errorf("received non-2xx response: %d", statusCode)
+	}
+
+	var result struct {
+		StatusCode int             `json:"statusCode"`
+		Body       json.RawMessage `json:"body"`
+		Message    string          `json:"message"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response body: %w", err)
+	}
+
+	if result.StatusCode != 0 {
+		countAPIResponse(tag{"status_code", strconv.Itoa(result.StatusCode)})
+	}
+
+	// A single status is handled as a list of one, keeping the configured
+	// device ID.
+	entries := []json.RawMessage{result.Body}
+	isList := bytes.HasPrefix(bytes.TrimSpace(result.Body), []byte("["))
+	if isList {
+		if err := json.Unmarshal(result.Body, &entries); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal response body: %w", err)
+		}
+		if len(entries) == 0 {
+			return nil, errors.New("response body lists no device statuses")
+		}
+	}
+
+	fetchedAt := c.now()
+	statuses := make([]*MeterProCO2Status, 0, len(entries))
+	for _, entry := range entries {
+		var b statusBody
+		if len(entry) > 0 {
+			if err := json.Unmarshal(entry, &b); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal response body: %w", err)
+			}
+		}
+
+		status := &MeterProCO2Status{
+			Temperature: (*float64)(b.Temperature),
+			Battery:     b.Battery,
+			Humidity:    b.Humidity,
+			CO2:         b.CO2,
+			FetchedAt:   fetchedAt,
+			Quality:     qualityFromStatusCode(result.StatusCode),
+			DeviceType:  b.DeviceType,
+			RSSI:        b.RSSI,
+
+			FirmwareVersion: b.Version,
+		}
+		if isList {
+			status.DeviceID = b.DeviceID
+		}
+		status.calibrate(*envValues)
+		if !envValues.PartialOK {
+			status.fillMissing()
+		}
+
+		if len(envValues.ExtraFields) > 0 && len(entry) > 0 {
+			var raw map[string]json.RawMessage
+			if err := json.Unmarshal(entry, &raw); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal response body: %w", err)
+			}
+			status.Extras = extractExtras(raw, envValues.ExtraFields)
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// extractExtras picks the named keys out of a status body, in the order
+// given. Numbers become float64 values; anything else is kept as a string.
+// Keys absent from the body are skipped.
+func extractExtras(body map[string]json.RawMessage, names []string) []metricField {
+	var extras []metricField
+	for _, name := range names {
+		raw, ok := body[name]
+		if !ok || string(raw) == "null" {
+			continue
+		}
+
+		var value any
+		var n float64
+		var s string
+		if err := json.Unmarshal(raw, &n); err == nil {
+			value = n
+		} else if err := json.Unmarshal(raw, &s); err == nil {
+			value = s
+		} else {
+			value = string(raw)
+		}
+		extras = append(extras, metricField{name: name, value: value})
+	}
+	return extras
+}
+
+// qualityFromStatusCode maps a SwitchBot body statusCode to a reading
+// quality. 161 and 171 mean the device or its hub is offline.
+func qualityFromStatusCode(statusCode int) string {
+	switch statusCode {
+	case 100:
+		return "ok"
+	case 161, 171:
+		return "offline"
+	default:
+		return "error"
+	}
+}
+
+// newNonce returns a random nonce for request signing.
+func newNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rewriteTransport sends every request to target, so the fixed SwitchBot
+// API URLs reach a test server.
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (rt rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = rt.target.Scheme
+	req.URL.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newTestSwitchBotClient returns a client whose requests are answered by
+// handler.
+func newTestSwitchBotClient(t *testing.T, envValues EnvValues, handler http.Handler) *switchBotClient {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newSwitchBotClient(&envValues)
+	c.httpClient = &http.Client{Transport: rewriteTransport{target}}
+	return c
+}
+
+func TestStatusBodyKeyCase(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"documented", `{"CO2": 812, "battery": 90, "humidity": 45, "temperature": 21.5}`},
+		{"lowercase co2", `{"co2": 812, "battery": 90, "humidity": 45, "temperature": 21.5}`},
+		{"uppercase", `{"CO2": 812, "BATTERY": 90, "Humidity": 45, "Temperature": 21.5}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b statusBody
+			if err := json.Unmarshal([]byte(tt.body), &b); err != nil {
+				t.Fatal(err)
+			}
+			if b.CO2 == nil || *b.CO2 != 812 {
+				t.Errorf("CO2 = %v, want 812", b.CO2)
+			}
+			if b.Battery == nil || *b.Battery != 90 {
+				t.Errorf("Battery = %v, want 90", b.Battery)
+			}
+			if b.Humidity == nil || *b.Humidity != 45 {
+				t.Errorf("Humidity = %v, want 45", b.Humidity)
+			}
+			if b.Temperature == nil || float64(*b.Temperature) != 21.5 {
+				t.Errorf("Temperature = %v, want 21.5", b.Temperature)
+			}
+		})
+	}
+}
+
+func TestSwitchBotGetOversizedResponse(t *testing.T) {
+	ev := testEnvValues(t, map[string]string{"MAX_RESPONSE_BYTES": "16"})
+	c := newTestSwitchBotClient(t, ev, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 17)))
+	}))
+
+	_, err := c.get(context.Background(), statusURL(ev.Co2DeviceID))
+	if err == nil || !strings.Contains(err.Error(), "exceeds limit of 16 bytes") {
+		t.Errorf("get() error = %v, want the response size limit exceeded", err)
+	}
+}
+
+// statusHandler answers every request with a successful status response
+// carrying body.
+func statusHandler(body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"statusCode": 100, "message": "success", "body": ` + body + `}`))
+	})
+}
+
+func TestPartialOK(t *testing.T) {
+	body := `{"deviceId": "DEV1", "temperature": 21.5, "battery": 90, "CO2": 812}`
+	tests := []struct {
+		partialOK    string
+		wantHumidity bool
+	}{
+		{"false", true},
+		{"true", false},
+	}
+	for _, tt := range tests {
+		t.Run("PARTIAL_OK="+tt.partialOK, func(t *testing.T) {
+			ev := testEnvValues(t, map[string]string{"PARTIAL_OK": tt.partialOK})
+			c := newTestSwitchBotClient(t, ev, statusHandler(body))
+
+			status, err := c.getMeterProCO2Status(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			metrics, err := formatMetrics(status, ev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Contains(metrics, " humidity="); got != tt.wantHumidity {
+				t.Errorf("humidity emitted = %v, want %v in\n%s", got, tt.wantHumidity, metrics)
+			}
+			if !strings.Contains(metrics, " co2=812") {
+				t.Errorf("co2 missing from\n%s", metrics)
+			}
+		})
+	}
+}
+
+func TestDecimalFloatUnmarshal(t *testing.T) {
+	tests := []struct {
+		json    string
+		want    float64
+		wantErr bool
+	}{
+		{`23.4`, 23.4, false},
+		{`-5`, -5, false},
+		{`"23.4"`, 23.4, false},
+		{`"23,4"`, 23.4, false},
+		{`" -0,5 "`, -0.5, false},
+		{`"warm"`, 0, true},
+	}
+	for _, tt := range tests {
+		var f decimalFloat
+		err := json.Unmarshal([]byte(tt.json), &f)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Unmarshal(%s): err = %v, want error %v", tt.json, err, tt.wantErr)
+			continue
+		}
+		if float64(f) != tt.want {
+			t.Errorf("Unmarshal(%s) = %v, want %v", tt.json, float64(f), tt.want)
+		}
+	}
+}
+
+func TestTemperatureScaleTenths(t *testing.T) {
+	ev := testEnvValues(t, map[string]string{"TEMPERATURE_SCALE": "0.1"})
+	c := newTestSwitchBotClient(t, ev, statusHandler(`{"temperature": 234, "battery": 90, "humidity": 45, "CO2": 812}`))
+
+	status, err := c.getMeterProCO2Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := *status.Temperature; math.Abs(got-23.4) > 1e-9 {
+		t.Errorf("Temperature = %v, want 23.4", got)
+	}
+}
+
+func TestNonJSONResponse(t *testing.T) {
+	ev := testEnvValues(t, nil)
+	c := newTestSwitchBotClient(t, ev, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("<html>\n  <body>502 Bad Gateway</body>\n</html>"))
+	}))
+
+	_, err := c.getMeterProCO2Status(context.Background())
+	if err == nil {
+		t.Fatal("HTML response accepted")
+	}
+	want := "received non-JSON response: 502, body: <html> <body>502 Bad Gateway</body> </html>"
+	if err.Error() != want {
+		t.Errorf("error = %q, want %q", err, want)
+	}
+}
+
+func TestBodySnippetTruncates(t *testing.T) {
+	got := bodySnippet([]byte(strings.Repeat("x", bodySnippetBytes+1)))
+	if want := strings.Repeat("x", bodySnippetBytes) + "..."; got != want {
+		t.Errorf("bodySnippet() = %q, want %q", got, want)
+	}
+}
+
+func TestRSSI(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want any
+	}{
+		{"present", `{"temperature": 21.5, "battery": 90, "humidity": 45, "CO2": 812, "rssi": -67}`, -67},
+		{"absent", `{"temperature": 21.5, "battery": 90, "humidity": 45, "CO2": 812}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := testEnvValues(t, map[string]string{"RSSI_ENABLED": "true"})
+			c := newTestSwitchBotClient(t, ev, statusHandler(tt.body))
+
+			status, err := c.getMeterProCO2Status(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := fieldValue(readingFields(status, ev), "rssi")
+			if got != tt.want {
+				t.Errorf("rssi = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcceptGzip(t *testing.T) {
+	body := `{"statusCode": 100, "message": "success", "body": {"temperature": 21.5, "battery": 90, "humidity": 45, "CO2": 812}}`
+	for _, compress := range []bool{true, false} {
+		t.Run(fmt.Sprintf("gzip=%v", compress), func(t *testing.T) {
+			ev := testEnvValues(t, map[string]string{"SWITCH_BOT_ACCEPT_GZIP": "true"})
+			c := newTestSwitchBotClient(t, ev, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Accept-Encoding"); got != "gzip" {
+					t.Errorf("Accept-Encoding = %q, want gzip", got)
+				}
+				if !compress {
+					w.Write([]byte(body))
+					return
+				}
+				w.Header().Set("Content-Encoding", "gzip")
+				gz := gzip.NewWriter(w)
+				gz.Write([]byte(body))
+				gz.Close()
+			}))
+
+			status, err := c.getMeterProCO2Status(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.CO2 == nil || *status.CO2 != 812 {
+				t.Errorf("CO2 = %v, want 812", status.CO2)
+			}
+		})
+	}
+}
+
+func TestStatusResponseShapes(t *testing.T) {
+	t.Run("single object", func(t *testing.T) {
+		ev := testEnvValues(t, nil)
+		c := newTestSwitchBotClient(t, ev, statusHandler(`{"deviceId": "OTHER", "temperature": 21.5, "battery": 90, "humidity": 45, "CO2": 812}`))
+
+		statuses, err := c.getMeterProCO2Statuses(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(statuses) != 1 {
+			t.Fatalf("got %d readings, want 1", len(statuses))
+		}
+		// An empty DeviceID keeps the configured CO2_DEVICE_ID.
+		if got := statuses[0].DeviceID; got != "" {
+			t.Errorf("DeviceID = %q, want the configured device", got)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		ev := testEnvValues(t, nil)
+		c := newTestSwitchBotClient(t, ev, statusHandler(`[
+			{"deviceId": "A1", "temperature": 21.5, "battery": 90, "humidity": 45, "CO2": 812},
+			{"deviceId": "B2", "temperature": 19.0, "battery": 80, "humidity": 50, "CO2": 640}
+		]`))
+
+		statuses, err := c.getMeterProCO2Statuses(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []struct {
+			deviceID string
+			co2      int
+		}{{"A1", 812}, {"B2", 640}}
+		if len(statuses) != len(want) {
+			t.Fatalf("got %d readings, want %d", len(statuses), len(want))
+		}
+		for i, w := range want {
+			if got := statuses[i].DeviceID; got != w.deviceID {
+				t.Errorf("reading %d: DeviceID = %q, want %q", i, got, w.deviceID)
+			}
+			if got := *statuses[i].CO2; got != w.co2 {
+				t.Errorf("reading %d: CO2 = %d, want %d", i, got, w.co2)
+			}
+		}
+	})
+
+	t.Run("empty list", func(t *testing.T) {
+		ev := testEnvValues(t, nil)
+		c := newTestSwitchBotClient(t, ev, statusHandler(`[]`))
+
+		if _, err := c.getMeterProCO2Statuses(context.Background()); err == nil {
+			t.Error("empty list accepted")
+		}
+	})
+}
+
+func TestUnauthorizedIsNotRetried(t *testing.T) {
+	ev := testEnvValues(t, nil)
+	requests := 0
+	c := newTestSwitchBotClient(t, ev, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"message":"Unauthorized"}`))
+	}))
+
+	_, err := c.getMeterProCO2Statuses(context.Background())
+	if !errors.Is(err, errAuthFailed) {
+		t.Errorf("error = %v, want errAuthFailed", err)
+	}
+	if requests != 1 {
+		t.Errorf("made %d requests, want 1", requests)
+	}
+}
+
+func TestResignOnClockSkew(t *testing.T) {
+	ev := testEnvValues(t, nil)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	serverNow := now.Add(time.Minute)
+
+	type signed struct{ t, nonce, sign string }
+	var requests []signed
+	c := newTestSwitchBotClient(t, ev, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, signed{r.Header.Get("t"), r.Header.Get("nonce"), r.Header.Get("sign")})
+		if len(requests) == 1 {
+			w.Header().Set("Date", serverNow.Format(http.TimeFormat))
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"message":"Unauthorized"}`))
+			return
+		}
+		statusHandler(`{"temperature": 21.5, "battery": 90, "humidity": 45, "CO2": 812}`).ServeHTTP(w, r)
+	}))
+	c.now = func() time.Time { return now }
+	nonces := 0
+	c.nonce = func() string {
+		nonces++
+		return fmt.Sprintf("nonce-%d", nonces)
+	}
+
+	if _, err := c.getMeterProCO2Statuses(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The signatures are HMAC-SHA256 of token+t+nonce keyed with the
+	// secret, base64 encoded.
+	want := []signed{
+		{"1714564800000", "nonce-1", "q9V2sFEkkjP5xEKmSdRXxcGx/BQ8nUMVQ485HKeB5Ag="},
+		{"1714564860000", "nonce-2", "1txd9NBYqRPPeWz2OIAVIfH3hX1kiukL4JNr+W2gO9w="},
+	}
+	if len(requests) != len(want) {
+		t.Fatalf("made %d requests, want %d", len(requests), len(want))
+	}
+	for i := range want {
+		if requests[i] != want[i] {
+			t.Errorf("request %d signed with %+v, want %+v", i+1, requests[i], want[i])
+		}
+	}
+}
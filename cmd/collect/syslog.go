@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// errSyslogUnavailable is returned when syslog cannot be used, either
+// because the platform lacks it or because no daemon could be reached.
+var errSyslogUnavailable = errors.New("syslog unavailable")
+
+// syslogFacilities maps facility names to their RFC 5424 codes.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverities maps severity names to their RFC 5424 codes.
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3,
+	"warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// emitSyslog writes each metrics line as a syslog message, falling back to
+// stdout when syslog is unavailable.
+func emitSyslog(metrics string, envValues EnvValues) error {
+	lines := strings.Split(strings.TrimSuffix(metrics, "\n"), "\n")
+	err := writeSyslog(lines, envValues)
+	if errors.Is(err, errSyslogUnavailable) {
+		log.Printf("Warning: %v, writing metrics to stdout instead", err)
+		_, err = fmt.Print(metrics)
+	}
+	return err
+}
@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package main
+
+import "fmt"
+
+func writeSyslog(lines []string, envValues EnvValues) error {
+	return fmt.Errorf("%w: not supported on this platform", errSyslogUnavailable)
+}
@@ -0,0 +1,25 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+func writeSyslog(lines []string, envValues EnvValues) error {
+	priority := syslog.Priority(syslogFacilities[envValues.SyslogFacility]<<3 | syslogSeverities[envValues.SyslogSeverity])
+
+	w, err := syslog.Dial(envValues.SyslogNetwork, envValues.SyslogAddr, priority, "metric-ferry")
+	if err != nil {
+		return fmt.Errorf("%w: %v", errSyslogUnavailable, err)
+	}
+	defer w.Close()
+
+	for _, line := range lines {
+		if _, err := w.Write([]byte(line)); err != nil {
+			return fmt.Errorf("failed to write to syslog: %w", err)
+		}
+	}
+	return nil
+}
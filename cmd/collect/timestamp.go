@@ -0,0 +1,21 @@
+package main
+
+import "time"
+
+var timestampUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// lineTimestamp returns how line protocol timestamps are encoded: the whole
+// number of TimestampUnit elapsed since TimestampEpoch. The defaults give
+// standard Unix nanoseconds.
+func lineTimestamp(envValues EnvValues) func(time.Time) int64 {
+	unit := timestampUnits[envValues.TimestampUnit]
+	epoch := time.Unix(envValues.TimestampEpoch, 0)
+	return func(t time.Time) int64 {
+		return int64(t.Sub(epoch) / unit)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLineTimestamp(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC)
+	unix := ts.Unix()
+	tests := []struct {
+		unit  string
+		epoch int64
+		want  int64
+	}{
+		{"ns", 0, ts.UnixNano()},
+		{"us", 0, ts.UnixMicro()},
+		{"ms", 0, ts.UnixMilli()},
+		{"s", 0, unix},
+		{"s", unix - 60, 60},
+		{"ms", unix - 60, 60123},
+		{"ms", unix + 60, -59876},
+	}
+	for _, tt := range tests {
+		ev := EnvValues{TimestampUnit: tt.unit, TimestampEpoch: tt.epoch}
+		if got := lineTimestamp(ev)(ts); got != tt.want {
+			t.Errorf("unit %s, epoch %d: got %d, want %d", tt.unit, tt.epoch, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"net"
+)
+
+// emitUDP sends metrics to UDP_ADDR, such as an InfluxDB UDP listener, split
+// at line boundaries into datagrams of at most UDP_MAX_DATAGRAM_BYTES. UDP
+// gives no delivery feedback, so sending is best-effort: failures are
+// logged and do not fail the run.
+func emitUDP(ctx context.Context, metrics string, envValues EnvValues) error {
+	datagrams, err := splitPayload(metrics, envValues.UDPMaxDatagramBytes)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("udp", envValues.UDPAddr)
+	if err != nil {
+		cyclePrintln(ctx, "Error sending metrics over UDP:", err)
+		return nil
+	}
+	defer conn.Close()
+
+	for _, datagram := range datagrams {
+		if _, err := conn.Write([]byte(datagram)); err != nil {
+			cyclePrintln(ctx, "Error sending metrics over UDP:", err)
+			return nil
+		}
+		debugf(ctx, "Sent %d byte datagram to %s", len(datagram), envValues.UDPAddr)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// emitUnixSocket writes metrics to the stream socket at UnixSocketPath. A
+// connection is opened per emit, so a restarted listener is picked up on
+// the next run; a write that fails on a connection the listener dropped is
+// retried once on a fresh one.
+func emitUnixSocket(ctx context.Context, metrics string, envValues EnvValues) error {
+	err := writeUnixSocket(ctx, metrics, envValues)
+	if err != nil {
+		debugf(ctx, "Unix socket write failed, reconnecting: %v", err)
+		err = writeUnixSocket(ctx, metrics, envValues)
+	}
+	return err
+}
+
+func writeUnixSocket(ctx context.Context, metrics string, envValues EnvValues) error {
+	ctx, cancel := context.WithTimeout(ctx, envValues.HTTPTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", envValues.UnixSocketPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", envValues.UnixSocketPath, err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetWriteDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	if _, err := conn.Write([]byte(metrics)); err != nil {
+		return fmt.Errorf("failed to write to %s: %w", envValues.UnixSocketPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import "runtime/debug"
+
+// version and commit identify the build. Release builds set them with
+// -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// buildCommit returns the commit set at link time, falling back to the VCS
+// revision Go stamps into binaries built from a checkout.
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				return s.Value
+			}
+		}
+	}
+	return "unknown"
+}
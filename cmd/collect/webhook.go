@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// switchBotWebhookEvent is the payload SwitchBot posts to a registered
+// webhook when a device reports a state change.
+type switchBotWebhookEvent struct {
+	EventType string `json:"eventType"`
+	Context   struct {
+		DeviceType  string        `json:"deviceType"`
+		DeviceMac   string        `json:"deviceMac"`
+		Temperature *decimalFloat `json:"temperature"`
+		Battery     *int          `json:"battery"`
+		Humidity    *int          `json:"humidity"`
+		CO2         *int          `json:"CO2"`
+	} `json:"context"`
+}
+
+func runWebhookServer(envValues EnvValues) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(envValues.WebhookPath, func(w http.ResponseWriter, r *http.Request) {
+		handleWebhook(w, r, envValues)
+	})
+
+	log.Printf("Listening for SwitchBot webhooks on %s%s", envValues.WebhookAddr, envValues.WebhookPath)
+	// No WriteTimeout: a handler publishes before answering, and the push
+	// has its own HTTP_TIMEOUT.
+	server := &http.Server{
+		Addr:              envValues.WebhookAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: envValues.HTTPTimeout,
+		ReadTimeout:       envValues.HTTPTimeout,
+		IdleTimeout:       2 * envValues.HTTPTimeout,
+	}
+	return server.ListenAndServe()
+}
+
+func handleWebhook(w http.ResponseWriter, r *http.Request, envValues EnvValues) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, envValues.WebhookMaxBodyBytes)
+	var event switchBotWebhookEvent
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, "invalid webhook payload", http.StatusBadRequest)
+		return
+	}
+
+	// SwitchBot retries deliveries that are not acknowledged, so events we
+	// don't care about are still answered with a 2xx.
+	if event.EventType != "changeReport" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if event.Context.DeviceMac == "" {
+		http.Error(w, "missing deviceMac", http.StatusBadRequest)
+		return
+	}
+	// Without a configured device, every device's reports are accepted and
+	// tagged with their own ID.
+	deviceID := strings.ToUpper(strings.ReplaceAll(event.Context.DeviceMac, ":", ""))
+	if envValues.Co2DeviceID == "" {
+		envValues.Co2DeviceID = deviceID
+	} else if !strings.EqualFold(deviceID, envValues.Co2DeviceID) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	status := &MeterProCO2Status{
+		Temperature: (*float64)(event.Context.Temperature),
+		Battery:     event.Context.Battery,
+		Humidity:    event.Context.Humidity,
+		CO2:         event.Context.CO2,
+		FetchedAt:   time.Now(),
+		Quality:     "ok",
+		DeviceType:  event.Context.DeviceType,
+	}
+	status.calibrate(envValues)
+	if !envValues.PartialOK {
+		status.fillMissing()
+	}
+
+	requestID := r.Header.Get(requestIDHeader)
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	ctx := withRequestID(r.Context(), requestID)
+	if err := publish(ctx, status, envValues); err != nil {
+		http.Error(w, "failed to publish metrics", http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleWebhookBodyLimit(t *testing.T) {
+	event := `{"eventType": "deviceOnline", "context": {"deviceMac": "AA:BB:CC:DD:EE:FF"}}`
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"within limit", event, http.StatusNoContent},
+		{"over limit", strings.Replace(event, "{", "{"+strings.Repeat(" ", 64), 1), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := EnvValues{WebhookMaxBodyBytes: int64(len(event) + 32)}
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			handleWebhook(rec, req, ev)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleWebhookEventFiltering(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"other event without deviceMac", `{"eventType": "deviceOnline", "context": {}}`, http.StatusNoContent},
+		{"changeReport without deviceMac", `{"eventType": "changeReport", "context": {"CO2": 812}}`, http.StatusBadRequest},
+		{"changeReport for another device", `{"eventType": "changeReport", "context": {"deviceMac": "11:22:33:44:55:66", "CO2": 812}}`, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := EnvValues{Co2DeviceID: "AABBCCDDEEFF", WebhookMaxBodyBytes: 1 << 16}
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			handleWebhook(rec, req, ev)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}